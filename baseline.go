@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrBaselineConflict = errors.New("action is in both the baseline and the never allow list")
+var ErrInvalidBaselineAction = errors.New("baseline actions must be written as service:Action")
+
+// baselineEntry is an action forced into or out of an SCP
+// along with the reason it is there
+type baselineEntry struct {
+	Action string `yaml:"action"`
+	Reason string `yaml:"reason"`
+}
+
+// UnmarshalYAML accepts an entry written as a bare
+// action as well as one with a reason. Node.Decode does
+// not check for unknown fields, so the keys are checked
+// here.
+func (e *baselineEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		e.Action = node.Value
+		return nil
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Value != "action" && key.Value != "reason" {
+				return fmt.Errorf("%w: line %d: field %s is not action or reason", ErrUnknownField, key.Line, key.Value)
+			}
+		}
+	}
+	type entry baselineEntry
+	return node.Decode((*entry)(e))
+}
+
+// baseline is a list of actions read from a baseline file
+type baseline []baselineEntry
+
+// loadBaseline decodes a YAML or JSON list of actions
+func loadBaseline(data []byte) (baseline, error) {
+	entries := baseline{}
+	if err := decodeKnownFields(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if service, action := splitAction(e.Action); service == "" || action == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidBaselineAction, e.Action)
+		}
+	}
+	return entries, nil
+}
+
+// splitAction splits an action into its service
+// prefix and name
+func splitAction(action string) (string, string) {
+	parts := strings.SplitN(action, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// match returns the entry matching an action, allowing
+// wildcards such as iam:Delete* in the entry
+func (b baseline) match(action string) (baselineEntry, bool) {
+	for _, e := range b {
+		if ok, _ := path.Match(strings.ToLower(e.Action), strings.ToLower(action)); ok {
+			return e, true
+		}
+	}
+	return baselineEntry{}, false
+}
+
+// check returns an error for an action both lists could
+// match, so iam:* conflicts with iam:DeleteRole and
+// iam:*Role with iam:Delete* whichever list they are in.
+// A never entry matching event names conflicts with the
+// iam actions the catalog translates them to as well.
+func (b baseline) check(never baseline, catalog actionCatalog) error {
+	for _, n := range never {
+		candidates := []string{n.Action}
+		prefix, name := splitAction(n.Action)
+		_, service, _ := catalog.service(prefix)
+		if !strings.Contains(name, "*") {
+			actions, _ := service.iamActions(name)
+			for _, action := range actions {
+				candidates = append(candidates, prefix+":"+action)
+			}
+		}
+		for eventName, actions := range service.EventNames {
+			if ok, _ := path.Match(strings.ToLower(name), strings.ToLower(eventName)); ok {
+				for _, action := range actions {
+					candidates = append(candidates, prefix+":"+action)
+				}
+			}
+		}
+
+		for _, e := range b {
+			for _, candidate := range candidates {
+				if patternsOverlap(strings.ToLower(e.Action), strings.ToLower(candidate)) {
+					return fmt.Errorf("%w: %s matches %s", ErrBaselineConflict, e.Action, n.Action)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// patternsOverlap reports whether some action could match
+// both patterns, where * matches any run of characters
+// and ? any single character
+func patternsOverlap(a string, b string) bool {
+	seen := map[[2]int]bool{}
+	var overlap func(i int, j int) bool
+	overlap = func(i int, j int) bool {
+		key := [2]int{i, j}
+		if done, ok := seen[key]; ok {
+			return done
+		}
+		seen[key] = false
+
+		var result bool
+		switch {
+		case i == len(a) && j == len(b):
+			result = true
+		case i < len(a) && a[i] == '*':
+			result = overlap(i+1, j) || (j < len(b) && overlap(i, j+1))
+		case j < len(b) && b[j] == '*':
+			result = overlap(i, j+1) || (i < len(a) && overlap(i+1, j))
+		case i == len(a) || j == len(b):
+			result = false
+		default:
+			result = (a[i] == '?' || b[j] == '?' || a[i] == b[j]) && overlap(i+1, j+1)
+		}
+		seen[key] = result
+		return result
+	}
+	return overlap(0, 0)
+}
+
+// override records an action forced into or out of an
+// SCP by a baseline, and why
+type override struct {
+	Action   string
+	Included bool
+	List     string
+	Reason   string
+}
+
+// String explains the override for the scp user
+func (o override) String() string {
+	return o.Action + " " + o.explanation()
+}
+
+// explanation says which list forced the action into
+// or out of the SCP and why
+func (o override) explanation() string {
+	outcome := "excluded by"
+	if o.Included {
+		outcome = "included by"
+	}
+	explanation := fmt.Sprintf("%s the %s", outcome, o.List)
+	if o.Reason != "" {
+		explanation += ": " + o.Reason
+	}
+	return explanation
+}
+
+// Baseline list names
+const (
+	listBaseline = "baseline"
+	listNever    = "never allow list"
+)
+
+// applyBaselines forces the include list into the
+// permissions and removes anything matching the exclude
+// list. An allow SCP includes the baseline and excludes
+// the never allow list, a deny SCP the reverse. An iam
+// action is excluded when it or the event name of any call
+// that needs it matches, as given by names.
+func applyBaselines(p permissions, names map[string][]string, include baseline, includeList string, exclude baseline, excludeList string) []override {
+	var overrides []override
+	for prefix, actions := range p {
+		for action := range actions {
+			key := prefix + ":" + action
+			for _, name := range append([]string{action}, names[strings.ToLower(key)]...) {
+				if e, ok := exclude.match(prefix + ":" + name); ok {
+					delete(actions, action)
+					overrides = append(overrides, override{Action: key, List: excludeList, Reason: e.Reason})
+					break
+				}
+			}
+		}
+		if len(actions) == 0 {
+			delete(p, prefix)
+		}
+	}
+
+	for _, e := range include {
+		service, action := splitAction(e.Action)
+		if _, ok := p[service][action]; ok {
+			continue
+		}
+		p.add(service, action, 0)
+		overrides = append(overrides, override{Action: e.Action, Included: true, List: includeList, Reason: e.Reason})
+	}
+
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Action < overrides[j].Action })
+	return overrides
+}
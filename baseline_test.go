@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadBaseline tests that entries may be bare
+// actions or actions with a reason
+func TestLoadBaseline(t *testing.T) {
+	entries, err := loadBaseline([]byte("- sts:AssumeRole\n- action: iam:Delete*\n  reason: no deletes\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, baseline{
+		{Action: "sts:AssumeRole"},
+		{Action: "iam:Delete*", Reason: "no deletes"},
+	}, entries)
+
+	entries, err = loadBaseline([]byte(`["kms:Decrypt"]`))
+	assert.Nil(t, err)
+	assert.Equal(t, baseline{{Action: "kms:Decrypt"}}, entries)
+}
+
+// TestLoadBaselineErrors tests that malformed files,
+// unknown fields and actions without a service are
+// rejected
+func TestLoadBaselineErrors(t *testing.T) {
+	_, err := loadBaseline([]byte("- [sts"))
+	assert.Error(t, err)
+
+	_, err = loadBaseline([]byte("- AssumeRole\n"))
+	assert.True(t, errors.Is(err, ErrInvalidBaselineAction))
+
+	_, err = loadBaseline([]byte("- action: {}\n"))
+	assert.Error(t, err)
+
+	_, err = loadBaseline([]byte("- action: sts:AssumeRole\n  reasons: sso\n"))
+	assert.True(t, errors.Is(err, ErrUnknownField))
+}
+
+// TestBaselineMatch tests exact and wildcard matches
+// regardless of case
+func TestBaselineMatch(t *testing.T) {
+	entries := baseline{{Action: "iam:Delete*"}, {Action: "sts:AssumeRole"}}
+
+	_, ok := entries.match("IAM:DeleteRole")
+	assert.True(t, ok)
+	_, ok = entries.match("sts:assumerole")
+	assert.True(t, ok)
+	_, ok = entries.match("iam:CreateRole")
+	assert.False(t, ok)
+}
+
+// TestBaselineCheck tests that an action can not be
+// both always and never allowed, whichever list holds
+// the wildcard
+func TestBaselineCheck(t *testing.T) {
+	always := baseline{{Action: "iam:DeleteRole"}}
+
+	assert.Nil(t, always.check(baseline{{Action: "iam:Create*"}}, defaultCatalog))
+	assert.True(t, errors.Is(always.check(baseline{{Action: "iam:Delete*"}}, defaultCatalog), ErrBaselineConflict))
+
+	wildcard := baseline{{Action: "iam:*"}}
+	assert.True(t, errors.Is(wildcard.check(baseline{{Action: "iam:DeleteRole"}}, defaultCatalog), ErrBaselineConflict))
+	assert.True(t, errors.Is(wildcard.check(baseline{{Action: "IAM:deleterole"}}, defaultCatalog), ErrBaselineConflict))
+	assert.Nil(t, wildcard.check(baseline{{Action: "sts:AssumeRole"}}, defaultCatalog))
+}
+
+// TestBaselineCheckWildcards tests that two wildcards
+// conflict when some action could match both, and that a
+// never entry naming an event name conflicts with the iam
+// actions it needs
+func TestBaselineCheckWildcards(t *testing.T) {
+	roles := baseline{{Action: "iam:*Role"}}
+
+	err := roles.check(baseline{{Action: "iam:Delete*"}}, defaultCatalog)
+	assert.True(t, errors.Is(err, ErrBaselineConflict))
+	assert.Equal(t, "action is in both the baseline and the never allow list: iam:*Role matches iam:Delete*", err.Error())
+	assert.True(t, errors.Is(baseline{{Action: "iam:Delete*"}}.check(roles, defaultCatalog), ErrBaselineConflict))
+	assert.Nil(t, roles.check(baseline{{Action: "iam:*User"}}, defaultCatalog))
+	assert.Nil(t, roles.check(baseline{{Action: "iam:Get?olicy"}}, defaultCatalog))
+
+	listing := baseline{{Action: "s3:ListBucket"}}
+	assert.True(t, errors.Is(listing.check(baseline{{Action: "s3:ListObjectsV2"}}, defaultCatalog), ErrBaselineConflict))
+	assert.True(t, errors.Is(listing.check(baseline{{Action: "s3:ListObjects*"}}, defaultCatalog), ErrBaselineConflict))
+	assert.Nil(t, listing.check(baseline{{Action: "s3:GetObject"}}, defaultCatalog))
+}
+
+// TestPatternsOverlap tests whether some action could
+// match two patterns
+func TestPatternsOverlap(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected bool
+	}{
+		{a: "iam:*role", b: "iam:delete*", expected: true},
+		{a: "iam:deleterole", b: "iam:deleterole", expected: true},
+		{a: "iam:deleterole", b: "iam:deleteuser", expected: false},
+		{a: "iam:*", b: "sts:assumerole", expected: false},
+		{a: "iam:*role", b: "iam:*user", expected: false},
+		{a: "iam:get?olicy", b: "iam:*policy", expected: true},
+		{a: "s3:get*acl", b: "s3:*bucket*", expected: true},
+		{a: "s3:get*", b: "s3:put*", expected: false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, patternsOverlap(c.a, c.b), c.a+" "+c.b)
+	}
+}
+
+// TestApplyBaselines tests that included actions are
+// added and excluded actions removed, matching on the
+// event names of the calls that need them as well
+func TestApplyBaselines(t *testing.T) {
+	p := permissions{
+		"s3":  {"ListAllMyBuckets": 145, "ListBucket": 12, "GetObject": 231},
+		"iam": {"DeleteRole": 2},
+		"sts": {"AssumeRole": 9},
+	}
+	names := map[string][]string{
+		"s3:listallmybuckets": {"ListBuckets"},
+		"s3:listbucket":       {"ListObjects", "ListObjectsV2"},
+		"s3:getobject":        {"GetObject", "CopyObject"},
+	}
+	include := baseline{{Action: "sts:AssumeRole"}, {Action: "support:DescribeCases", Reason: "support access"}}
+	exclude := baseline{{Action: "s3:ListAllMyBuckets", Reason: "no listing"}, {Action: "s3:ListObjectsV2"}, {Action: "iam:Delete*"}}
+
+	overrides := applyBaselines(p, names, include, listBaseline, exclude, listNever)
+
+	assert.Equal(t, permissions{
+		"s3":      {"GetObject": 231},
+		"sts":     {"AssumeRole": 9},
+		"support": {"DescribeCases": 0},
+	}, p)
+	assert.Equal(t, []override{
+		{Action: "iam:DeleteRole", List: listNever},
+		{Action: "s3:ListAllMyBuckets", List: listNever, Reason: "no listing"},
+		{Action: "s3:ListBucket", List: listNever},
+		{Action: "support:DescribeCases", Included: true, List: listBaseline, Reason: "support access"},
+	}, overrides)
+}
+
+// TestOverrideString tests the explanation of an override
+func TestOverrideString(t *testing.T) {
+	included := override{Action: "sts:AssumeRole", Included: true, List: listBaseline, Reason: "break glass access"}
+	excluded := override{Action: "iam:DeleteRole", List: listNever}
+
+	assert.Equal(t, "sts:AssumeRole included by the baseline: break glass access", included.String())
+	assert.Equal(t, "iam:DeleteRole excluded by the never allow list", excluded.String())
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// catalogData is the bundled per service iam action catalog
+//
+//go:embed data/iam_actions.json
+var catalogData []byte
+
+// serviceCatalog lists every iam action of a single service
+// and the CloudTrail event names that do not share the name
+// of the action they need
+type serviceCatalog struct {
+	Actions    []string            `json:"actions"`
+	EventNames map[string][]string `json:"event_names,omitempty"`
+}
+
+// versionSuffix matches the api version CloudTrail appends to
+// some event names, ListFunctions20150331 or GetFunction20150331v2
+var versionSuffix = regexp.MustCompile(`\d{8}(v\d+)?$`)
+
+// actionCatalog maps an iam service prefix to its actions
+type actionCatalog map[string]serviceCatalog
+
+// defaultCatalog is the catalog bundled with the binary
+var defaultCatalog = mustLoadCatalog(catalogData)
+
+// loadCatalog decodes an action catalog
+func loadCatalog(jsonData []byte) (actionCatalog, error) {
+	catalog := actionCatalog{}
+	if err := json.Unmarshal(jsonData, &catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func mustLoadCatalog(jsonData []byte) actionCatalog {
+	catalog, err := loadCatalog(jsonData)
+	if err != nil {
+		panic(err)
+	}
+	return catalog
+}
+
+// service returns the canonical prefix of a service
+// along with its catalog entry
+func (c actionCatalog) service(prefix string) (string, serviceCatalog, bool) {
+	if service, ok := c[prefix]; ok {
+		return prefix, service, true
+	}
+	for name, service := range c {
+		if strings.EqualFold(name, prefix) {
+			return name, service, true
+		}
+	}
+	return strings.ToLower(prefix), serviceCatalog{}, false
+}
+
+// action returns the catalog spelling of an action
+func (s serviceCatalog) action(name string) (string, bool) {
+	for _, action := range s.Actions {
+		if strings.EqualFold(action, name) {
+			return action, true
+		}
+	}
+	return "", false
+}
+
+// iamActions translates a CloudTrail event name into the
+// iam actions it needs. The event name is returned as is
+// when the catalog does not know it.
+func (s serviceCatalog) iamActions(eventName string) ([]string, bool) {
+	for name, actions := range s.EventNames {
+		if strings.EqualFold(name, eventName) {
+			return actions, true
+		}
+	}
+	if action, ok := s.action(eventName); ok {
+		return []string{action}, true
+	}
+	if action, ok := s.action(versionSuffix.ReplaceAllString(eventName, "")); ok {
+		return []string{action}, true
+	}
+	return []string{eventName}, false
+}
+
+// translate rewrites permissions keyed by event name into
+// permissions keyed by iam action with canonical service
+// prefixes. The actions of catalogued services the catalog
+// does not know are returned so they can be flagged. The
+// catalog does not cover every service, so the actions of
+// the others are kept as they are without being flagged.
+func (c actionCatalog) translate(p permissions) (permissions, []string) {
+	translated := permissions{}
+	var unknown []string
+	for prefix, eventNames := range p {
+		name, service, known := c.service(prefix)
+		for eventName, count := range eventNames {
+			actions, ok := service.iamActions(eventName)
+			if known && !ok {
+				unknown = append(unknown, name+":"+eventName)
+			}
+			for _, action := range actions {
+				translated.add(name, action, count)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return translated, unknown
+}
+
+// translateUsage rewrites usage keyed by event name into
+// usage keyed by the iam actions the calls need, so calls
+// are selected on the actions that end up in the SCP. An
+// action needed by several event names counts the calls of
+// each, ListObjects and ListObjectsV2 both count towards
+// s3:ListBucket. The event names of the calls are kept
+// with each action. Calls from unknown event sources are
+// kept as they are. Actions stay in the order first seen.
+func (c actionCatalog) translateUsage(reportData *Report, sources eventSourceMap) *Report {
+	translated := &Report{Usage: []Usage{}}
+	index := map[apiCall]int{}
+	for _, v := range reportData.Usage {
+		actions := []string{v.EventName}
+		if prefix, ok := sources.serviceName(v.EventSource); ok {
+			_, service, _ := c.service(prefix)
+			actions, _ = service.iamActions(v.EventName)
+		}
+
+		for _, action := range actions {
+			call := apiCall{eventSource: v.EventSource, eventName: action}
+			i, ok := index[call]
+			if !ok {
+				i = len(translated.Usage)
+				index[call] = i
+				translated.Usage = append(translated.Usage, Usage{EventSource: v.EventSource, EventName: action})
+			}
+			translated.Usage[i].Count += v.Count
+			if !containsString(translated.Usage[i].EventNames, v.EventName) {
+				translated.Usage[i].EventNames = append(translated.Usage[i].EventNames, v.EventName)
+			}
+		}
+	}
+	return translated
+}
+
+// containsString reports whether a list holds a string
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// calledAs maps each service:action of translated usage,
+// in lower case, to the event names of the calls that
+// need it
+func calledAs(reportData *Report, sources eventSourceMap) map[string][]string {
+	names := map[string][]string{}
+	for _, v := range reportData.Usage {
+		if service, ok := sources.serviceName(v.EventSource); ok {
+			key := strings.ToLower(service + ":" + v.EventName)
+			names[key] = append(names[key], v.EventNames...)
+		}
+	}
+	return names
+}
+
+// compactSCP collapses the actions of every statement
+// into prefix wildcards where it is safe to do so
+func compactSCP(scp SCP, catalog actionCatalog) SCP {
+	compacted := SCP{Version: scp.Version}
+	for _, statement := range scp.Statement {
+		statement.Action = compactActions(statement.Action, catalog)
+		compacted.Statement = append(compacted.Statement, statement)
+	}
+	return compacted
+}
+
+// compactActions replaces groups of actions of the same
+// service with the shortest prefix wildcard whose catalog
+// matches are all in the original list, so the wildcard
+// never covers an action outside the intended set. Services
+// missing from the catalog are left untouched. A wildcard
+// takes the place of the first action it covers.
+func compactActions(actions []string, catalog actionCatalog) []string {
+	selected := map[string]bool{}
+	for _, action := range actions {
+		selected[strings.ToLower(action)] = true
+	}
+
+	covered := map[string]bool{}
+	var compacted []string
+	for _, action := range actions {
+		if covered[strings.ToLower(action)] {
+			continue
+		}
+
+		parts := strings.SplitN(action, ":", 2)
+		service, ok := catalog[strings.ToLower(parts[0])]
+		if len(parts) != 2 || !ok {
+			compacted = append(compacted, action)
+			continue
+		}
+
+		wildcard, matches := safeWildcard(parts[0], parts[1], service, selected)
+		if wildcard == "" {
+			compacted = append(compacted, action)
+			continue
+		}
+
+		for _, match := range matches {
+			covered[strings.ToLower(match)] = true
+		}
+		compacted = append(compacted, wildcard)
+	}
+	return compacted
+}
+
+// safeWildcard returns the shortest prefix wildcard for an
+// action that covers at least two catalog actions, all of
+// which are selected, along with the actions it covers. The
+// prefix keeps at least the first word of the action, as a
+// bare service:* would also cover actions AWS adds later.
+func safeWildcard(prefix string, action string, service serviceCatalog, selected map[string]bool) (string, []string) {
+	words := camelWords(action)
+	for i := 1; i <= len(words); i++ {
+		stem := strings.Join(words[:i], "")
+
+		var matches []string
+		safe := true
+		for _, candidate := range service.Actions {
+			if !strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(stem)) {
+				continue
+			}
+			if !selected[strings.ToLower(prefix+":"+candidate)] {
+				safe = false
+				break
+			}
+			matches = append(matches, prefix+":"+candidate)
+		}
+
+		if safe && len(matches) > 1 {
+			return prefix + ":" + stem + "*", matches
+		}
+	}
+	return "", nil
+}
+
+// camelWords splits an action name into its words,
+// GetBucketPolicy becomes Get, Bucket, Policy
+func camelWords(action string) []string {
+	var words []string
+	runes := []rune(action)
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && !unicode.IsUpper(runes[i-1]) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	if len(runes) > 0 {
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+// lintSCP returns the actions of a policy that are valid
+// but most likely mistakes: actions the catalog does not
+// know, wildcards that match nothing, and actions listed
+// twice or already covered by a wildcard. The catalog
+// does not cover every service, so the services whose
+// actions could not be checked are returned separately
+// rather than as findings.
+func lintSCP(scp SCP, catalog actionCatalog) ([]string, []string) {
+	var findings []string
+	var unchecked []string
+	uncheckedSeen := map[string]bool{}
+	for i, statement := range scp.Statement {
+		name := fmt.Sprintf("statement %d", i+1)
+		if statement.Sid != "" {
+			name = fmt.Sprintf("statement %s", statement.Sid)
+		}
+
+		seen := map[string]bool{}
+		actions := append(append([]string{}, statement.Action...), statement.NotAction...)
+		for _, action := range actions {
+			key := strings.ToLower(action)
+			if seen[key] {
+				findings = append(findings, fmt.Sprintf("%s: %s is listed more than once", name, action))
+				continue
+			}
+			seen[key] = true
+
+			finding, known := catalog.lintAction(action)
+			if finding != "" {
+				findings = append(findings, fmt.Sprintf("%s: %s", name, finding))
+			}
+			if prefix, _ := splitAction(key); !known && !uncheckedSeen[prefix] {
+				uncheckedSeen[prefix] = true
+				unchecked = append(unchecked, prefix)
+			}
+			for _, other := range actions {
+				if other != action && strings.Contains(other, "*") && !strings.Contains(action, "*") {
+					if ok, _ := path.Match(strings.ToLower(other), key); ok {
+						findings = append(findings, fmt.Sprintf("%s: %s is already covered by %s", name, action, other))
+						break
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(unchecked)
+	return findings, unchecked
+}
+
+// lintAction checks an action against the catalog,
+// reporting false when the catalog does not cover the
+// service of the action so it could not be checked
+func (c actionCatalog) lintAction(action string) (string, bool) {
+	prefix, name := splitAction(action)
+	if action == "*" || prefix == "" {
+		return "", true
+	}
+	_, service, known := c.service(prefix)
+	if !known {
+		return "", false
+	}
+	if !strings.Contains(name, "*") {
+		if _, ok := service.action(name); !ok {
+			return fmt.Sprintf("%s is not in the action catalog", action), true
+		}
+		return "", true
+	}
+	for _, candidate := range service.Actions {
+		if ok, _ := path.Match(strings.ToLower(name), strings.ToLower(candidate)); ok {
+			return "", true
+		}
+	}
+	return fmt.Sprintf("%s matches no action in the catalog", action), true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDefaultCatalog tests that the bundled catalog loads
+func TestDefaultCatalog(t *testing.T) {
+	assert.Contains(t, defaultCatalog["s3"].Actions, "GetObject")
+	assert.Contains(t, defaultCatalog["kms"].Actions, "Decrypt")
+}
+
+// TestLoadCatalogError tests that a corrupt catalog
+// returns an error
+func TestLoadCatalogError(t *testing.T) {
+	_, err := loadCatalog([]byte(`{"s3": ["GetObject"]}`))
+	assert.Error(t, err)
+	assert.Panics(t, func() { mustLoadCatalog([]byte(`{`)) })
+}
+
+// TestCamelWords tests that action names are split
+// into their words
+func TestCamelWords(t *testing.T) {
+	assert.Equal(t, []string{"Get", "Bucket", "Policy"}, camelWords("GetBucketPolicy"))
+	assert.Equal(t, []string{"Put", "Bucket", "CORS"}, camelWords("PutBucketCORS"))
+	assert.Equal(t, []string{"Decrypt"}, camelWords("Decrypt"))
+	assert.Equal(t, []string(nil), camelWords(""))
+}
+
+// TestCompactActions tests that only wildcards covering
+// nothing outside the selected actions are used
+func TestCompactActions(t *testing.T) {
+	cases := []struct {
+		actions  []string
+		expected []string
+	}{
+		{
+			actions: []string{"kms:Decrypt", "kms:ListAliases", "kms:ListGrants", "kms:ListKeyPolicies",
+				"kms:ListKeys", "kms:ListResourceTags", "kms:ListRetirableGrants"},
+			expected: []string{"kms:Decrypt", "kms:List*"},
+		},
+		{
+			actions:  []string{"kms:ListAliases", "kms:ListKeyPolicies", "kms:ListKeys"},
+			expected: []string{"kms:ListAliases", "kms:ListKey*"},
+		},
+		{
+			actions:  []string{"kms:ListKeys", "kms:Decrypt"},
+			expected: []string{"kms:ListKeys", "kms:Decrypt"},
+		},
+		{
+			actions:  []string{"xray:GetGroups", "xray:GetInsightSummaries"},
+			expected: []string{"xray:GetGroups", "xray:GetInsightSummaries"},
+		},
+		{
+			actions: []string{"sts:AssumeRole", "sts:AssumeRoleWithSAML", "sts:AssumeRoleWithWebIdentity",
+				"sts:DecodeAuthorizationMessage", "sts:GetAccessKeyInfo", "sts:GetCallerIdentity",
+				"sts:GetFederationToken", "sts:GetServiceBearerToken", "sts:GetSessionToken",
+				"sts:SetSourceIdentity", "sts:TagSession"},
+			expected: []string{"sts:Assume*", "sts:DecodeAuthorizationMessage", "sts:Get*", "sts:SetSourceIdentity", "sts:TagSession"},
+		},
+		{
+			actions:  []string{"STS:AssumeRole", "sts:assumerolewithsaml", "sts:AssumeRoleWithWebIdentity", "s3:HeadBucket"},
+			expected: []string{"STS:Assume*", "s3:HeadBucket"},
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, compactActions(c.actions, defaultCatalog))
+	}
+}
+
+// TestCompactActionsWholeService tests that selecting every
+// catalogued action of a service never gives service:*
+func TestCompactActionsWholeService(t *testing.T) {
+	for prefix, service := range defaultCatalog {
+		var actions []string
+		for _, action := range service.Actions {
+			actions = append(actions, prefix+":"+action)
+		}
+
+		for _, action := range compactActions(actions, defaultCatalog) {
+			assert.NotEqual(t, prefix+":*", action)
+		}
+	}
+}
+
+// TestCompactSCPWithinSizeLimit tests that the compact
+// oversize mode brings a large SCP within the limit
+func TestCompactSCPWithinSizeLimit(t *testing.T) {
+	largePermissions := permissions{}
+	for _, service := range []string{"s3", "lambda", "cloudformation"} {
+		for _, action := range defaultCatalog[service].Actions {
+			largePermissions.add(service, action, 10)
+		}
+	}
+	largePermissions.add("xray", "GetGroups", 10)
+
+	testSCPRun := getTestSCPRun()
+	testSCPRun.catalog = defaultCatalog
+	testSCPRun.permissionSet = largePermissions
+	testSCPRun.createSCP()
+	assert.True(t, scpSize(testSCPRun.scp) > maxSCPSize)
+
+	err := testSCPRun.fitSCP()
+
+	assert.Nil(t, err)
+	actions := []string(testSCPRun.documents[0].Statement[0].Action)
+	assert.True(t, scpSize(testSCPRun.documents[0]) <= maxSCPSize)
+	assert.Contains(t, actions, "s3:Get*")
+	assert.Contains(t, actions, "xray:GetGroups")
+	assert.NotContains(t, actions, "s3:*")
+}
+
+// TestCreateSCPCompact tests that the compact flag
+// collapses actions whatever the size
+func TestCreateSCPCompact(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.catalog = defaultCatalog
+	testSCPRun.compact = true
+	testSCPRun.permissionSet = permissions{"kms": {"ListKeys": 1, "ListKeyPolicies": 1}}
+
+	err := testSCPRun.createSCP()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kms:ListKey*"}, []string(testSCPRun.scp.Statement[0].Action))
+}
+
+// TestIAMActions tests that event names are translated
+// into the iam actions they need
+func TestIAMActions(t *testing.T) {
+	cases := []struct {
+		service   string
+		eventName string
+		expected  []string
+		known     bool
+	}{
+		{service: "s3", eventName: "ListBuckets", expected: []string{"ListAllMyBuckets"}, known: true},
+		{service: "s3", eventName: "CopyObject", expected: []string{"GetObject", "PutObject"}, known: true},
+		{service: "s3", eventName: "getobject", expected: []string{"GetObject"}, known: true},
+		{service: "lambda", eventName: "ListFunctions20150331", expected: []string{"ListFunctions"}, known: true},
+		{service: "lambda", eventName: "GetFunctionConfiguration20150331v2", expected: []string{"GetFunctionConfiguration"}, known: true},
+		{service: "lambda", eventName: "ListProvisionedConcurrencyConfigs", expected: []string{"ListProvisionedConcurrencyConfigs"}, known: true},
+		{service: "s3", eventName: "tLifecycle", expected: []string{"tLifecycle"}, known: false},
+	}
+
+	for _, c := range cases {
+		actions, known := defaultCatalog[c.service].iamActions(c.eventName)
+		assert.Equal(t, c.expected, actions, c.eventName)
+		assert.Equal(t, c.known, known, c.eventName)
+	}
+}
+
+// TestTranslate tests that permissions are rewritten with
+// canonical prefixes and actions and unknown ones reported,
+// leaving out services the catalog does not cover
+func TestTranslate(t *testing.T) {
+	translated, unknown := defaultCatalog.translate(permissions{
+		"S3":     {"ListObjects": 3, "HeadBucket": 2, "CopyObject": 1, "tLifecycle": 1},
+		"Lambda": {"ListFunctions20150331": 4},
+		"Xray":   {"GetGroups": 5},
+	})
+
+	assert.Equal(t, permissions{
+		"s3":     {"ListBucket": 5, "GetObject": 1, "PutObject": 1, "tLifecycle": 1},
+		"lambda": {"ListFunctions": 4},
+		"xray":   {"GetGroups": 5},
+	}, translated)
+	assert.Equal(t, []string{"s3:tLifecycle"}, unknown)
+}
+
+// TestTranslateUsage tests that the calls of event names
+// sharing an iam action are summed into that action, which
+// keeps the event names
+func TestTranslateUsage(t *testing.T) {
+	translated := defaultCatalog.translateUsage(&Report{Usage: []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "ListObjectsV2", Count: 900},
+		{EventSource: "s3.amazonaws.com", EventName: "CopyObject", Count: 1},
+		{EventSource: "s3.amazonaws.com", EventName: "ListObjects", Count: 1},
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 1000},
+		{EventSource: "unknown.amazonaws.com", EventName: "ListObjects", Count: 7},
+	}}, defaultEventSources)
+
+	assert.Equal(t, []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "ListBucket", Count: 901, EventNames: []string{"ListObjectsV2", "ListObjects"}},
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 1001, EventNames: []string{"CopyObject", "GetObject"}},
+		{EventSource: "s3.amazonaws.com", EventName: "PutObject", Count: 1, EventNames: []string{"CopyObject"}},
+		{EventSource: "unknown.amazonaws.com", EventName: "ListObjects", Count: 7, EventNames: []string{"ListObjects"}},
+	}, translated.Usage)
+}
+
+// TestLintSCP tests that unknown, duplicate and
+// redundant actions are reported, and services missing
+// from the catalog are listed once as unchecked
+func TestLintSCP(t *testing.T) {
+	scp := SCP{Version: policyVersion, Statement: Statements{
+		{Sid: "Allow", Effect: "Allow", Action: StringList{"s3:Get*", "s3:GetObject", "S3:getobject", "s3:Fly*", "s3:Teleport", "xray:GetGroups"}},
+		{Effect: "Deny", NotAction: StringList{"kms:Decrypt", "kms:decrypt", "XRay:GetTraceSummaries"}},
+	}}
+
+	findings, unchecked := lintSCP(scp, defaultCatalog)
+
+	assert.Equal(t, []string{
+		"statement Allow: s3:GetObject is already covered by s3:Get*",
+		"statement Allow: S3:getobject is listed more than once",
+		"statement Allow: s3:Fly* matches no action in the catalog",
+		"statement Allow: s3:Teleport is not in the action catalog",
+		"statement 2: kms:decrypt is listed more than once",
+	}, findings)
+	assert.Equal(t, []string{"xray"}, unchecked)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultCloudFormationFilename     = "testSCP.template.yaml"
+	defaultCloudFormationJSONFilename = "testSCP.template.json"
+	cloudFormationVersion             = "2010-09-09"
+)
+
+// cfnTemplate is a CloudFormation template deploying
+// the documents of an SCP. Intrinsic functions use their
+// long form so the template reads the same as YAML or JSON.
+type cfnTemplate struct {
+	AWSTemplateFormatVersion string                 `yaml:"AWSTemplateFormatVersion" json:"AWSTemplateFormatVersion"`
+	Description              string                 `yaml:"Description" json:"Description"`
+	Parameters               cfnParameters          `yaml:"Parameters" json:"Parameters"`
+	Conditions               map[string]interface{} `yaml:"Conditions" json:"Conditions"`
+	Resources                map[string]cfnPolicy   `yaml:"Resources" json:"Resources"`
+	Outputs                  map[string]cfnOutput   `yaml:"Outputs" json:"Outputs"`
+}
+
+type cfnParameters struct {
+	PolicyName        cfnParameter `yaml:"PolicyName" json:"PolicyName"`
+	PolicyDescription cfnParameter `yaml:"PolicyDescription" json:"PolicyDescription"`
+	TargetIds         cfnParameter `yaml:"TargetIds" json:"TargetIds"`
+}
+
+type cfnParameter struct {
+	Type        string `yaml:"Type" json:"Type"`
+	Default     string `yaml:"Default" json:"Default"`
+	Description string `yaml:"Description" json:"Description"`
+}
+
+type cfnPolicy struct {
+	Type       string              `yaml:"Type" json:"Type"`
+	Properties cfnPolicyProperties `yaml:"Properties" json:"Properties"`
+}
+
+type cfnPolicyProperties struct {
+	Name        interface{} `yaml:"Name" json:"Name"`
+	Description interface{} `yaml:"Description" json:"Description"`
+	Type        string      `yaml:"Type" json:"Type"`
+	TargetIds   interface{} `yaml:"TargetIds" json:"TargetIds"`
+	Content     SCP         `yaml:"Content" json:"Content"`
+}
+
+type cfnOutput struct {
+	Description string      `yaml:"Description" json:"Description"`
+	Value       interface{} `yaml:"Value" json:"Value"`
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"Ref": name}
+}
+
+// newCloudFormationTemplate wraps each document in an
+// AWS::Organizations::Policy resource. The name, description
+// and targets are parameters defaulting to the details.
+// Documents of a split SCP are numbered.
+func newCloudFormationTemplate(documents []SCP, details policyDetails) cfnTemplate {
+	template := cfnTemplate{
+		AWSTemplateFormatVersion: cloudFormationVersion,
+		Description:              details.Description,
+		Parameters: cfnParameters{
+			PolicyName:        cfnParameter{Type: "String", Default: details.Name, Description: "Name of the service control policy"},
+			PolicyDescription: cfnParameter{Type: "String", Default: details.Description, Description: "Description of the service control policy"},
+			TargetIds:         cfnParameter{Type: "CommaDelimitedList", Default: strings.Join(details.Targets, ","), Description: "Organizational unit, account or root ids to attach the policy to"},
+		},
+		Conditions: map[string]interface{}{
+			"HasTargets": map[string]interface{}{"Fn::Not": []interface{}{
+				map[string]interface{}{"Fn::Equals": []interface{}{
+					map[string]interface{}{"Fn::Join": []interface{}{"", ref("TargetIds")}}, "",
+				}},
+			}},
+		},
+		Resources: map[string]cfnPolicy{},
+		Outputs:   map[string]cfnOutput{},
+	}
+
+	for i, scp := range documents {
+		resource, name := "ServiceControlPolicy", interface{}(ref("PolicyName"))
+		if len(documents) > 1 {
+			resource += strconv.Itoa(i + 1)
+			name = map[string]interface{}{"Fn::Sub": "${PolicyName}-" + strconv.Itoa(i+1)}
+		}
+		template.Resources[resource] = cfnPolicy{
+			Type: "AWS::Organizations::Policy",
+			Properties: cfnPolicyProperties{
+				Name:        name,
+				Description: ref("PolicyDescription"),
+				Type:        "SERVICE_CONTROL_POLICY",
+				TargetIds:   map[string]interface{}{"Fn::If": []interface{}{"HasTargets", ref("TargetIds"), ref("AWS::NoValue")}},
+				Content:     scp,
+			},
+		}
+		template.Outputs[resource+"Id"] = cfnOutput{Description: "Id of the service control policy", Value: ref(resource)}
+	}
+	return template
+}
+
+// renderCloudFormation renders the template as YAML,
+// or as JSON for the cloudformation-json format
+func renderCloudFormation(documents []SCP, details policyDetails, format string) ([]byte, error) {
+	template := newCloudFormationTemplate(documents, details)
+	if format == formatCloudFormationJSON {
+		return json.MarshalIndent(template, "", "  ")
+	}
+
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(template); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+	return output.Bytes(), nil
+}
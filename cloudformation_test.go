@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// parseTestTemplate round trips a rendered template
+// through a YAML parser
+func parseTestTemplate(t *testing.T, output []byte) map[string]interface{} {
+	template := map[string]interface{}{}
+	if err := yaml.Unmarshal(output, &template); err != nil {
+		t.Fatalf("template is not valid YAML: %v", err)
+	}
+	return template
+}
+
+// templateSCP reads the policy of a resource back into
+// the SCP model
+func templateSCP(t *testing.T, template map[string]interface{}, resource string) SCP {
+	resources := template["Resources"].(map[string]interface{})
+	properties := resources[resource].(map[string]interface{})["Properties"].(map[string]interface{})
+	jsonData, _ := json.Marshal(properties["Content"])
+	scp, err := parseSCP(jsonData)
+	if err != nil {
+		t.Fatalf("template content is not a policy: %v", err)
+	}
+	return scp
+}
+
+// TestRenderCloudFormation tests that YAML and JSON
+// templates hold the SCP and its parameters
+func TestRenderCloudFormation(t *testing.T) {
+	scp := generateSCP("Deny", permissions{"s3": {"PutObject": 1, "DeleteObject": 1}}, sortByName, nil)
+	details := policyDetails{Name: "platform-deny", Description: "Denies unused s3 writes", Targets: []string{"ou-ab12-34567890", "123456789012"}}
+
+	for _, format := range []string{formatCloudFormation, formatCloudFormationJSON} {
+		output, err := renderCloudFormation([]SCP{scp}, details, format)
+		assert.Nil(t, err)
+
+		template := parseTestTemplate(t, output)
+		assert.Equal(t, cloudFormationVersion, template["AWSTemplateFormatVersion"], format)
+		parameters := template["Parameters"].(map[string]interface{})
+		assert.Equal(t, "platform-deny", parameters["PolicyName"].(map[string]interface{})["Default"], format)
+		assert.Equal(t, "Denies unused s3 writes", parameters["PolicyDescription"].(map[string]interface{})["Default"], format)
+		assert.Equal(t, "ou-ab12-34567890,123456789012", parameters["TargetIds"].(map[string]interface{})["Default"], format)
+
+		resource := template["Resources"].(map[string]interface{})["ServiceControlPolicy"].(map[string]interface{})
+		assert.Equal(t, "AWS::Organizations::Policy", resource["Type"], format)
+		properties := resource["Properties"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"Ref": "PolicyName"}, properties["Name"], format)
+		assert.Equal(t, "SERVICE_CONTROL_POLICY", properties["Type"], format)
+		assert.Equal(t, scp, templateSCP(t, template, "ServiceControlPolicy"), format)
+	}
+}
+
+// TestRenderCloudFormationYAML tests that the policy is
+// written as block YAML keeping its key order
+func TestRenderCloudFormationYAML(t *testing.T) {
+	scp := generateSCP("Allow", permissions{"s3": {"GetObject": 1}}, sortByName, nil)
+
+	output, _ := renderCloudFormation([]SCP{scp}, policyDetails{Name: "allow"}, formatCloudFormation)
+
+	assert.Contains(t, string(output), ""+
+		"      Content:\n"+
+		"        Version: \"2012-10-17\"\n"+
+		"        Statement:\n"+
+		"          - Sid: AllowScannerUsage\n"+
+		"            Effect: Allow\n"+
+		"            Action:\n"+
+		"              - s3:GetObject\n"+
+		"            Resource:\n"+
+		"              - '*'\n")
+}
+
+// TestRenderCloudFormationSplit tests that each document
+// of a split SCP gets its own numbered resource and name
+func TestRenderCloudFormationSplit(t *testing.T) {
+	documents, _ := splitSCP(generateSCP("Deny", getLargePermissions(500), sortByName, nil), maxSCPSize)
+
+	output, err := renderCloudFormation(documents, policyDetails{Name: "large"}, formatCloudFormation)
+
+	assert.Nil(t, err)
+	template := parseTestTemplate(t, output)
+	assert.Len(t, template["Resources"], len(documents))
+	assert.Len(t, template["Outputs"], len(documents))
+	properties := template["Resources"].(map[string]interface{})["ServiceControlPolicy2"].(map[string]interface{})["Properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"Fn::Sub": "${PolicyName}-2"}, properties["Name"])
+	assert.Equal(t, documents[1], templateSCP(t, template, "ServiceControlPolicy2"))
+}
+
+// TestRunCloudFormation tests that the SCP can be written
+// as a CloudFormation template
+func TestRunCloudFormation(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.Output = filepath.Dir(c.Output)
+	c.Format = formatCloudFormation
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	output, _ := ioutil.ReadFile(filepath.Join(c.Output, defaultCloudFormationFilename))
+	template := parseTestTemplate(t, output)
+	scp := templateSCP(t, template, "ServiceControlPolicy")
+	assert.Equal(t, []string{"s3:GetObject", "s3:ListAllMyBuckets"}, []string(scp.Statement[0].Action))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrNotCloudTrailLog = errors.New("file has no CloudTrail Records")
+
+// cloudTrailRecord is the part of a CloudTrail event
+// needed to count api calls
+type cloudTrailRecord struct {
+	EventSource        string `json:"eventSource"`
+	EventName          string `json:"eventName"`
+	RecipientAccountID string `json:"recipientAccountId"`
+	UserIdentity       struct {
+		Type           string `json:"type"`
+		ARN            string `json:"arn"`
+		AccountID      string `json:"accountId"`
+		InvokedBy      string `json:"invokedBy"`
+		SessionContext struct {
+			SessionIssuer struct {
+				ARN string `json:"arn"`
+			} `json:"sessionIssuer"`
+		} `json:"sessionContext"`
+	} `json:"userIdentity"`
+}
+
+// account returns the account the call was made in
+func (r cloudTrailRecord) account() string {
+	if r.RecipientAccountID != "" {
+		return r.RecipientAccountID
+	}
+	return r.UserIdentity.AccountID
+}
+
+// principal returns who made the call. Assumed role
+// sessions are counted against the role they came from.
+func (r cloudTrailRecord) principal() string {
+	identity := r.UserIdentity
+	switch {
+	case identity.SessionContext.SessionIssuer.ARN != "":
+		return identity.SessionContext.SessionIssuer.ARN
+	case identity.ARN != "":
+		return identity.ARN
+	case identity.InvokedBy != "":
+		return identity.InvokedBy
+	}
+	return identity.Type
+}
+
+// cloudTrailPrincipal identifies a principal of an account
+type cloudTrailPrincipal struct {
+	account   string
+	principal string
+}
+
+// cloudTrailUsage counts the calls of a single principal,
+// keeping them in the order first seen
+type cloudTrailUsage struct {
+	report *Report
+	calls  map[apiCall]int
+}
+
+// add counts a call made by the principal
+func (u *cloudTrailUsage) add(c apiCall) {
+	if i, ok := u.calls[c]; ok {
+		u.report.Usage[i].Count++
+		return
+	}
+	u.calls[c] = len(u.report.Usage)
+	u.report.Usage = append(u.report.Usage, Usage{EventSource: c.eventSource, EventName: c.eventName, Count: 1})
+}
+
+// expectDelim reads the next token of a CloudTrail log,
+// which must be the delimiter given
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("%w: expected %v", ErrNotCloudTrailLog, delim)
+	}
+	return nil
+}
+
+// decodeCloudTrail counts the api calls in a CloudTrail log
+// file, streaming its Records one event at a time. The calls
+// of each principal of each account are handed to fn as a
+// single report once the whole file has been read.
+func decodeCloudTrail(r io.Reader, fn func(Report)) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	var principals []cloudTrailPrincipal
+	usage := map[cloudTrailPrincipal]*cloudTrailUsage{}
+	found := false
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key != "Records" {
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return err
+			}
+			continue
+		}
+
+		found = true
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var record cloudTrailRecord
+			if err := dec.Decode(&record); err != nil {
+				return err
+			}
+			if record.EventSource == "" || record.EventName == "" {
+				continue
+			}
+
+			p := cloudTrailPrincipal{account: record.account(), principal: record.principal()}
+			if _, ok := usage[p]; !ok {
+				report := &Report{Description: "CloudTrail events of " + p.principal, Usage: []Usage{}, Principal: p.principal}
+				report.Account.Identifier = p.account
+				usage[p] = &cloudTrailUsage{report: report, calls: map[apiCall]int{}}
+				principals = append(principals, p)
+			}
+			usage[p].add(apiCall{eventSource: record.EventSource, eventName: record.EventName})
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotCloudTrailLog
+	}
+
+	for _, p := range principals {
+		fn(*usage[p].report)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gzipTestLog compresses a CloudTrail log as it is
+// delivered to S3
+func gzipTestLog(log string) string {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(log))
+	writer.Close()
+	return compressed.String()
+}
+
+// getCloudTrailLog returns a log file of calls made
+// by a user of an account
+func getCloudTrailLog(account string, user string, eventNames ...string) string {
+	var records []string
+	for _, eventName := range eventNames {
+		records = append(records, `{"userIdentity": {"type": "IAMUser", "arn": "arn:aws:iam::`+account+`:user/`+user+`"},
+			"eventSource": "s3.amazonaws.com", "eventName": "`+eventName+`", "recipientAccountId": "`+account+`"}`)
+	}
+	return `{"Records": [` + strings.Join(records, ",") + `]}`
+}
+
+// TestDecodeCloudTrail tests that calls are counted per
+// principal of each account, with assumed role sessions
+// counted against their role
+func TestDecodeCloudTrail(t *testing.T) {
+	logData, _ := ioutil.ReadFile("./testdata/cloudtrail_log.json")
+
+	var reports []Report
+	err := decodeCloudTrail(bytes.NewReader(logData), func(r Report) {
+		reports = append(reports, r)
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, reports, 3)
+	assert.Equal(t, "638924580364", reports[0].Account.Identifier)
+	assert.Equal(t, "arn:aws:iam::638924580364:role/deployer", reports[0].Principal)
+	assert.Equal(t, []Usage{{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 2}}, reports[0].Usage)
+	assert.Equal(t, "arn:aws:iam::638924580364:user/webops", reports[1].Principal)
+	assert.Equal(t, []Usage{{EventSource: "s3.amazonaws.com", EventName: "ListBuckets", Count: 1}}, reports[1].Usage)
+	assert.Equal(t, "cloudtrail.amazonaws.com", reports[2].Principal)
+	assert.Equal(t, "638924580364", reports[2].Account.Identifier)
+}
+
+// TestDecodeCloudTrailErrors tests that objects without
+// Records and malformed logs are rejected
+func TestDecodeCloudTrailErrors(t *testing.T) {
+	for _, log := range []string{`{"Version": "2012-10-17"}`, `{"Records": {}}`, `[]`} {
+		err := decodeCloudTrail(strings.NewReader(log), func(Report) {})
+		assert.True(t, errors.Is(err, ErrNotCloudTrailLog), log)
+	}
+
+	err := decodeCloudTrail(strings.NewReader(`{"Records": [{"eventSource": 1}]}`), func(Report) {})
+	assert.Error(t, err)
+
+	var reports []Report
+	err = decodeCloudTrail(strings.NewReader(`{"Records": [{"eventName": "GetObject"}], "digest": true}`), func(r Report) {
+		reports = append(reports, r)
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, reports)
+}
+
+// TestDecodeUsageGzip tests that gzipped CloudTrail logs
+// and scanner reports are decompressed before decoding
+func TestDecodeUsageGzip(t *testing.T) {
+	for _, data := range []string{
+		gzipTestLog(getCloudTrailLog("111111111111", "webops", "GetObject")),
+		gzipTestLog(getScannerReport("111111111111", "GetObject")),
+	} {
+		var reports []Report
+		err := decodeUsage(strings.NewReader(data), func(r Report) {
+			reports = append(reports, r)
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "111111111111", reports[0].Account.Identifier)
+		assert.Equal(t, "GetObject", reports[0].Usage[0].EventName)
+	}
+}
+
+// TestScannerFilesCloudTrail tests that the gzipped logs
+// CloudTrail delivers are found in a directory
+func TestScannerFilesCloudTrail(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"a.json.gz": gzipTestLog(getCloudTrailLog("111111111111", "webops", "GetObject")),
+		"b.csv.GZ":  gzipTestLog("s3.amazonaws.com,GetObject,1\n"),
+		"c.txt.gz":  gzipTestLog("notes"),
+	})
+
+	files, skipped, _, err := scannerFiles(directory, false)
+
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, []skippedFile{{filename: filepath.Join(directory, "c.txt.gz"), reason: errNotReportFile}}, skipped)
+}
+
+// TestMergePrincipal tests that principal mode judges each
+// call on the principal that makes it most
+func TestMergePrincipal(t *testing.T) {
+	usage := newUsageAggregator()
+	for _, log := range []string{
+		getCloudTrailLog("111111111111", "webops", "GetObject", "GetObject", "GetObject"),
+		getCloudTrailLog("111111111111", "deployer", "GetObject", "GetObject"),
+		getCloudTrailLog("222222222222", "webops", "GetObject"),
+	} {
+		decodeCloudTrail(strings.NewReader(log), usage.add)
+	}
+
+	expected := map[string]int64{mergeSum: 6, mergeAccount: 5, mergePrincipal: 3}
+	for mode, count := range expected {
+		merged, err := usage.merge(mode)
+		assert.Nil(t, err)
+		assert.Equal(t, count, merged.Usage[0].Count, mode)
+	}
+}
+
+// TestRunCloudTrailDirectory tests that an SCP is generated
+// from a directory of CloudTrail logs as delivered to S3
+func TestRunCloudTrailDirectory(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"AWSLogs/111111111111/CloudTrail/eu-west-2/2021/03/01/a.json.gz": gzipTestLog(getCloudTrailLog("111111111111", "webops", "GetObject", "GetObject")),
+		"AWSLogs/111111111111/CloudTrail/eu-west-2/2021/03/02/b.json.gz": gzipTestLog(getCloudTrailLog("111111111111", "webops", "PutObject", "GetObject")),
+		"AWSLogs/111111111111/CloudTrail-Digest/eu-west-2/d.json.gz":     gzipTestLog(`{"digestStartTime": "2021-03-01T00:00:00Z"}`),
+	})
+	c := getTestSCPConfig(t, directory)
+	c.Recursive = true
+	c.Threshold = 3
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, []string{"s3:GetObject"}, []string(scp.Statement[0].Action))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+var ErrMissingPolicy = errors.New("at least one policy file is required")
+var ErrUnexpectedArgument = errors.New("unexpected argument")
+
+// command is an awsscp subcommand with its own flags
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+// commands returns every subcommand in the order
+// they are listed in the help
+func commands() []command {
+	return []command{
+		{name: "generate", args: "[flags]", summary: "generate an SCP from scanner usage reports", run: generateCommand},
+		{name: "diff", args: "-against policy.json [flags]", summary: "compare a generated SCP with an existing policy", run: diffCommand},
+		{name: "explain", args: "[flags]", summary: "generate an SCP and show why each api call is or is not in it", run: explainCommand},
+		{name: "validate", args: "[flags] policy.json...", summary: "check policies against the rules AWS applies to SCPs", run: validateCommand},
+		{name: "lint", args: "[flags] policy.json...", summary: "report unknown, duplicate and redundant actions in policies", run: lintCommand},
+		{name: "config", args: "print [flags]", summary: "print the effective generate parameters and where they came from", run: configCommand},
+	}
+}
+
+// execute runs the subcommand named by the first argument
+// and returns the process exit code. Arguments starting
+// with a flag run generate, as awsscp did before it had
+// subcommands.
+func execute(args []string) int {
+	name := "generate"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		return help(args)
+	}
+
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(stderr, "%v %q\n", ErrUnknownCommand, name)
+		printUsage()
+		return exitUsage
+	}
+
+	fs := cmd.flagSet()
+	if err := cmd.run(fs, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(stderr, err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// findCommand returns the subcommand with the given name
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// flagSet returns an empty flag set for the command whose
+// usage describes the command
+func (c command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: awsscp %s %s\n\n%s\n\nflags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// help prints the usage of a command, or of awsscp
+// when no command is named
+func help(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 0
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(stderr, "%v %q\n", ErrUnknownCommand, args[0])
+		printUsage()
+		return exitUsage
+	}
+	fs := cmd.flagSet()
+	cmd.run(fs, []string{"-h"})
+	return 0
+}
+
+// printUsage lists the subcommands
+func printUsage() {
+	fmt.Fprintf(stderr, "usage: awsscp <command> [flags]\n\ncommands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(stderr, "\nrun awsscp help <command> for the flags of a command\n")
+}
+
+// usageError classes an error as caused by invalid parameters
+func usageError(err error) error {
+	return newStageError(stage{name: "usage", exitCode: exitUsage}, err)
+}
+
+// parseConfig parses the generate flags, filling in the
+// rest from the environment and config file
+func parseConfig(fs *flag.FlagSet, args []string) (*SCPConfig, error) {
+	c := &SCPConfig{}
+	c.setup(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, usageError(err)
+	}
+	if fs.NArg() > 0 {
+		return nil, usageError(fmt.Errorf("%w %q", ErrUnexpectedArgument, fs.Arg(0)))
+	}
+	if err := c.resolve(fs); err != nil {
+		return nil, newStageError(stage{name: "config", exitCode: exitUsage}, err)
+	}
+	return c, nil
+}
+
+// generateCommand runs the scp pipeline
+func generateCommand(fs *flag.FlagSet, args []string) error {
+	c, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	return run(c)
+}
+
+// configCommand prints the effective configuration
+func configCommand(fs *flag.FlagSet, args []string) error {
+	if len(args) > 0 && args[0] == "print" {
+		c, err := parseConfig(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		c.print(stdout, fs)
+		return nil
+	}
+
+	(&SCPConfig{}).setup(fs)
+	if err := fs.Parse(args); err != nil {
+		return usageError(err)
+	}
+	return usageError(fmt.Errorf("%w: use awsscp config print", ErrInvalidParameters))
+}
+
+// diffCommand generates an SCP and compares it with an
+// existing policy instead of saving it, failing when they
+// differ
+func diffCommand(fs *flag.FlagSet, args []string) error {
+	against := fs.String("against", "", "existing policy file to compare the generated SCP with")
+	asJSON := fs.Bool("json", false, "print the differences as json")
+	c, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if *against == "" {
+		return usageError(fmt.Errorf("%w: -against", ErrMissingPolicy))
+	}
+
+	scpRun := newSCPRun(c)
+	var existing SCP
+	stages := []stage{{name: "existing", exitCode: exitInput, run: func() error {
+		existing, err = loadSCP(*against)
+		return err
+	}}}
+	if err := scpRun.runStages(append(stages, scpRun.policyStages()...)); err != nil {
+		return err
+	}
+
+	d := diffSCP(existing, scpRun.scp)
+	if *asJSON {
+		jsonData, _ := json.MarshalIndent(d, "", " ")
+		fmt.Fprintln(stdout, string(jsonData))
+	} else {
+		d.write(stdout)
+	}
+	if d.changed() {
+		return newStageError(stage{name: "diff", exitCode: exitDiff}, ErrPolicyChanged)
+	}
+	return nil
+}
+
+// explainCommand generates an SCP without saving it and
+// prints the decision made about every api call
+func explainCommand(fs *flag.FlagSet, args []string) error {
+	asJSON := fs.Bool("json", false, "print the decisions as json")
+	c, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	scpRun := newSCPRun(c)
+	if err := scpRun.runStages(scpRun.policyStages()); err != nil {
+		return err
+	}
+	if *asJSON {
+		jsonData, _ := json.MarshalIndent(scpRun.decisions, "", " ")
+		fmt.Fprintln(stdout, string(jsonData))
+		return nil
+	}
+	return writeDecisions(stdout, scpRun.decisions)
+}
+
+// validateCommand checks each policy file against the
+// rules AWS applies to SCPs
+func validateCommand(fs *flag.FlagSet, args []string) error {
+	policies, err := parsePolicyArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	return checkPolicies(policies, "validate", validateSCP)
+}
+
+// lintCommand reports actions in each policy file that
+// are most likely mistakes
+func lintCommand(fs *flag.FlagSet, args []string) error {
+	catalogFilename := fs.String("catalog", "", "action catalog file to use instead of the bundled one")
+	policies, err := parsePolicyArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	scpRun := SCPRun{catalogFilename: *catalogFilename}
+	if err := scpRun.getCatalog(); err != nil {
+		return newStageError(stage{name: "catalog", exitCode: exitInput}, err)
+	}
+	noted := map[string]bool{}
+	return checkPolicies(policies, "lint", func(scp SCP) []string {
+		findings, unchecked := lintSCP(scp, scpRun.catalog)
+		for _, service := range unchecked {
+			if !noted[service] {
+				noted[service] = true
+				fmt.Fprintf(stderr, "note: %s is not in the action catalog, its actions are not checked\n", service)
+			}
+		}
+		return findings
+	})
+}
+
+// parsePolicyArgs parses the flags of a command that
+// takes policy files as its arguments
+func parsePolicyArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, usageError(err)
+	}
+	if fs.NArg() == 0 {
+		return nil, usageError(ErrMissingPolicy)
+	}
+	return fs.Args(), nil
+}
+
+// checkPolicies loads each policy and prints what the
+// check finds in it, failing when anything was found
+func checkPolicies(filenames []string, name string, check func(SCP) []string) error {
+	found := 0
+	for _, filename := range filenames {
+		scp, err := loadSCP(filename)
+		if err != nil {
+			return newStageError(stage{name: "load", exitCode: exitInput}, fmt.Errorf("%s: %w", filename, err))
+		}
+		for _, problem := range check(scp) {
+			fmt.Fprintf(stdout, "%s: %s\n", filename, problem)
+			found++
+		}
+	}
+
+	if found > 0 {
+		return newStageError(stage{name: name, exitCode: exitPolicy}, fmt.Errorf("%w: %d found", ErrPolicyProblems, found))
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// executeTest runs awsscp with the given arguments and
+// returns the exit code along with stdout and stderr
+func executeTest(t *testing.T, args ...string) (int, string, string) {
+	loadFile = ioutil.ReadFile
+	var output, errors bytes.Buffer
+	stdout, stderr = &output, &errors
+	defer func() { stdout, stderr = os.Stdout, ioutil.Discard }()
+
+	code := execute(args)
+	return code, output.String(), errors.String()
+}
+
+// TestExecuteGenerate tests that generate runs the
+// pipeline, with or without naming the command
+func TestExecuteGenerate(t *testing.T) {
+	for _, args := range [][]string{
+		{"generate", "-fileloc", "./testdata/s3_scanner_report.json", "-out", "-"},
+		{"-fileloc", "./testdata/s3_scanner_report.json", "-out", "-"},
+	} {
+		code, output, _ := executeTest(t, args...)
+
+		assert.Equal(t, 0, code)
+		assert.Contains(t, output, "s3:GetObject")
+	}
+}
+
+// TestExecuteGenerateDefaultOutput tests that without
+// -out each format is written to a file named after it
+func TestExecuteGenerateDefaultOutput(t *testing.T) {
+	scannerFile, _ := filepath.Abs("./testdata/s3_scanner_report.json")
+	workingDir, _ := os.Getwd()
+	t.Cleanup(func() { os.Chdir(workingDir) })
+
+	cases := map[string]string{
+		formatYAML:               defaultSCPYAMLFilename,
+		formatTerraform:          defaultTerraformFilename,
+		formatCloudFormation:     defaultCloudFormationFilename,
+		formatCloudFormationJSON: defaultCloudFormationJSONFilename,
+	}
+	for format, expected := range cases {
+		directory := t.TempDir()
+		os.Chdir(directory)
+
+		code, _, _ := executeTest(t, "-fileloc", scannerFile, "-format", format)
+
+		assert.Equal(t, 0, code, format)
+		assert.FileExists(t, filepath.Join(directory, expected), format)
+		assert.NoFileExists(t, filepath.Join(directory, defaultSCPFilename), format)
+	}
+}
+
+// TestExecuteGenerateErrors tests that generate failures
+// are reported with their exit code
+func TestExecuteGenerateErrors(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected int
+		message  string
+	}{
+		{args: []string{"generate", "-fileloc", "./testdata/missing.json"}, expected: exitInput, message: "load: "},
+		{args: []string{"generate", "-threshold", "ten"}, expected: exitUsage, message: "usage: "},
+		{args: []string{"generate", "extra"}, expected: exitUsage, message: `usage: unexpected argument "extra"`},
+		{args: []string{"generate", "-config", "./testdata/missing.yaml"}, expected: exitUsage, message: "config: "},
+	}
+
+	for _, c := range cases {
+		code, _, errors := executeTest(t, c.args...)
+
+		assert.Equal(t, c.expected, code, c.args)
+		assert.Contains(t, errors, c.message, c.args)
+	}
+}
+
+// TestExecuteHelp tests the help of awsscp and of
+// each command
+func TestExecuteHelp(t *testing.T) {
+	code, _, errors := executeTest(t, "help")
+	assert.Equal(t, 0, code)
+	for _, cmd := range commands() {
+		assert.Contains(t, errors, cmd.name)
+	}
+
+	code, _, errors = executeTest(t, "help", "lint")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, errors, "usage: awsscp lint")
+	assert.Contains(t, errors, "-catalog")
+
+	code, _, errors = executeTest(t, "generate", "-h")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, errors, "-threshold")
+
+	code, _, errors = executeTest(t, "help", "config")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, errors, "usage: awsscp config print")
+}
+
+// TestExecuteUnknownCommand tests that an unknown
+// command is a usage error
+func TestExecuteUnknownCommand(t *testing.T) {
+	code, _, errors := executeTest(t, "deploy")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, errors, `unknown command "deploy"`)
+
+	code, _, _ = executeTest(t, "help", "deploy")
+	assert.Equal(t, exitUsage, code)
+}
+
+// TestExecuteConfigPrint tests that config print shows
+// the effective parameters
+func TestExecuteConfigPrint(t *testing.T) {
+	code, output, _ := executeTest(t, "config", "print", "-config", "./testdata/config.yaml")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, output, "threshold: 50 # file\n")
+
+	code, _, _ = executeTest(t, "config", "print", "-threshold", "ten")
+	assert.Equal(t, exitUsage, code)
+
+	code, _, errors := executeTest(t, "config", "show")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, errors, "use awsscp config print")
+}
+
+// TestExecuteValidate tests that problems are listed
+// and fail the command
+func TestExecuteValidate(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	ioutil.WriteFile(invalid, []byte(`{"Version": "2008-10-17", "Statement": {"Effect": "Allow", "Action": "s3:GetObject"}}`), 0644)
+
+	code, _, _ := executeTest(t, "validate", "./testdata/golden/allow_by_name.json")
+	assert.Equal(t, 0, code)
+
+	code, output, errors := executeTest(t, "validate", "./testdata/golden/allow_by_name.json", invalid)
+	assert.Equal(t, exitPolicy, code)
+	assert.Equal(t, invalid+": Version must be 2012-10-17\n", output)
+	assert.True(t, strings.HasPrefix(errors, "validate: policy has problems: 1 found"))
+
+	code, _, _ = executeTest(t, "validate", "./testdata/s3_scanner_report.json")
+	assert.Equal(t, exitInput, code)
+
+	code, _, errors = executeTest(t, "validate")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, errors, ErrMissingPolicy.Error())
+
+	code, _, _ = executeTest(t, "validate", "-strict")
+	assert.Equal(t, exitUsage, code)
+}
+
+// TestExecuteLint tests that findings are listed and
+// fail the command, while services missing from the
+// catalog are only noted
+func TestExecuteLint(t *testing.T) {
+	clean := filepath.Join(t.TempDir(), "clean.json")
+	ioutil.WriteFile(clean, []byte(`{"Version": "2012-10-17", "Statement": {"Effect": "Allow", "Action": ["s3:Get*", "kms:Decrypt"]}}`), 0644)
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	ioutil.WriteFile(policy, []byte(`{"Version": "2012-10-17", "Statement": {"Effect": "Allow", "Action": ["s3:Get*", "s3:GetObject"]}}`), 0644)
+
+	code, _, _ := executeTest(t, "lint", clean)
+	assert.Equal(t, 0, code)
+
+	uncatalogued := filepath.Join(t.TempDir(), "uncatalogued.json")
+	ioutil.WriteFile(uncatalogued, []byte(`{"Version": "2012-10-17", "Statement": {"Effect": "Allow", "Action": ["xray:GetGroups", "xray:PutTraceSegments"]}}`), 0644)
+	code, output, errors := executeTest(t, "lint", uncatalogued, uncatalogued)
+	assert.Equal(t, 0, code)
+	assert.Empty(t, output)
+	assert.Equal(t, "note: xray is not in the action catalog, its actions are not checked\n", errors)
+
+	code, output, _ = executeTest(t, "lint", policy)
+	assert.Equal(t, exitPolicy, code)
+	assert.Equal(t, policy+": statement 1: s3:GetObject is already covered by s3:Get*\n", output)
+
+	code, _, _ = executeTest(t, "lint", "-catalog", "./testdata/missing.json", policy)
+	assert.Equal(t, exitInput, code)
+
+	code, _, _ = executeTest(t, "lint")
+	assert.Equal(t, exitUsage, code)
+}
+
+// TestExecuteDiff tests that diff compares the generated
+// SCP with an existing policy without saving it
+func TestExecuteDiff(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "scp.json")
+	generate := []string{"-fileloc", "./testdata/s3_usage.json", "-threshold", "2", "-out", output}
+
+	code, diff, _ := executeTest(t, append([]string{"diff", "-against", "./testdata/golden/allow_by_name.json"}, generate...)...)
+	assert.Equal(t, 0, code)
+	assert.True(t, strings.HasPrefix(diff, "effect: Allow\nsize: "))
+	assert.NoFileExists(t, output)
+
+	code, diff, errors := executeTest(t, "diff", "-json", "-against", "./testdata/golden/allow_by_name.json",
+		"-fileloc", "./testdata/s3_scanner_report.json")
+	assert.Equal(t, exitDiff, code)
+	assert.Contains(t, diff, `"added": [`)
+	assert.Contains(t, errors, "diff: policy has changed")
+
+	code, _, _ = executeTest(t, append([]string{"diff", "-against", "./testdata/missing.json"}, generate...)...)
+	assert.Equal(t, exitInput, code)
+
+	code, _, _ = executeTest(t, append([]string{"diff"}, generate...)...)
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = executeTest(t, "diff", "-threshold", "ten")
+	assert.Equal(t, exitUsage, code)
+}
+
+// TestExecuteYAMLPolicies tests that validate and diff
+// read existing YAML policies
+func TestExecuteYAMLPolicies(t *testing.T) {
+	code, _, _ := executeTest(t, "validate", "./testdata/golden/allow_by_name.yaml")
+	assert.Equal(t, 0, code)
+
+	code, diff, _ := executeTest(t, "diff", "-against", "./testdata/golden/allow_by_name.yaml",
+		"-fileloc", "./testdata/s3_usage.json", "-threshold", "2", "-format", "yaml")
+	assert.Equal(t, 0, code)
+	assert.True(t, strings.HasPrefix(diff, "effect: Allow\nsize: "))
+}
+
+// TestExecuteExplain tests that explain prints a decision
+// for every api call without saving the SCP or review
+func TestExecuteExplain(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "scp.json")
+	review := filepath.Join(t.TempDir(), "review.md")
+	generate := []string{"-fileloc", "./testdata/s3_scanner_report.json", "-out", output, "-review", review}
+
+	code, table, _ := executeTest(t, append([]string{"explain"}, generate...)...)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, table, "s3:ListAllMyBuckets       ListBuckets            145    count     10         yes       in scp")
+	assert.Contains(t, table, "s3:GetBucketNotification  GetBucketNotification  1      count     10         no        left out")
+	assert.NoFileExists(t, output)
+	assert.NoFileExists(t, review)
+
+	code, decisions, _ := executeTest(t, append([]string{"explain", "-json"}, generate...)...)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, decisions, `"action": "s3:GetObject"`)
+	assert.Contains(t, decisions, `"in_policy_as": "s3:GetObject"`)
+	assert.Contains(t, decisions, `"event_names": [`)
+
+	code, _, _ = executeTest(t, append([]string{"explain", "-threshold", "0"}, generate...)...)
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = executeTest(t, "explain", "extra")
+	assert.Equal(t, exitUsage, code)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables read by the generator. Every
+// parameter can be set by prefixing its upper cased flag
+// name, so -unknown-source becomes AWSSCP_UNKNOWN_SOURCE.
+const (
+	envPrefix  = "AWSSCP_"
+	configEnv  = envPrefix + "CONFIG"
+	configFlag = "config"
+)
+
+// Where the effective value of a parameter came from,
+// from lowest to highest precedence
+const (
+	originDefault = "default"
+	originFile    = "file"
+	originEnv     = "env"
+	originFlag    = "flag"
+)
+
+var ErrUnknownConfigKey = errors.New("unknown config file parameter")
+var ErrInvalidConfigValue = errors.New("config file parameters must be a single value")
+
+// Package level var to allow patch testing
+type envLookup func(key string) (string, bool)
+
+var lookupEnv envLookup = os.LookupEnv
+
+// envName returns the environment variable of a parameter
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig decodes a YAML or JSON config file keyed by
+// flag name into the string form of each value
+func loadConfig(data []byte) (map[string]string, error) {
+	decoded := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for name, value := range decoded {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%w: %s", ErrInvalidConfigValue, name)
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// resolve fills in the parameters not given as flags from
+// the environment and then the config file, recording
+// where each value came from. The config file is named by
+// -config or AWSSCP_CONFIG. An output file not given at
+// all is named after the output format.
+func (s *SCPConfig) resolve(fs *flag.FlagSet) error {
+	s.origins = map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) { s.origins[f.Name] = originDefault })
+	fs.Visit(func(f *flag.Flag) { s.origins[f.Name] = originFlag })
+
+	if err := s.resolveEnv(fs); err != nil {
+		return err
+	}
+	if err := s.resolveFile(fs); err != nil {
+		return err
+	}
+	if s.origins["out"] == originDefault {
+		s.Output = scpFilename(s.Format)
+	}
+	return nil
+}
+
+// resolveFile sets the parameters given neither as flags
+// nor in the environment from the config file
+func (s *SCPConfig) resolveFile(fs *flag.FlagSet) error {
+	if s.ConfigFile == "" {
+		return nil
+	}
+
+	configData, err := loadFile(s.ConfigFile)
+	if err != nil {
+		return err
+	}
+	values, err := loadConfig(configData)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.ConfigFile, err)
+	}
+	for name, value := range values {
+		if fs.Lookup(name) == nil || name == configFlag {
+			return fmt.Errorf("%s: %w: %s", s.ConfigFile, ErrUnknownConfigKey, name)
+		}
+		if s.origins[name] != originDefault {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", s.ConfigFile, name, err)
+		}
+		s.origins[name] = originFile
+	}
+	return nil
+}
+
+// resolveEnv sets the parameters not given as flags
+// from their environment variables
+func (s *SCPConfig) resolveEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		if err != nil || !ok || s.origins[f.Name] != originDefault {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+			return
+		}
+		s.origins[f.Name] = originEnv
+	})
+	return err
+}
+
+// print writes the effective value of every parameter
+// and where it came from as YAML
+func (s *SCPConfig) print(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		value, _ := json.Marshal(f.Value.(flag.Getter).Get())
+		fmt.Fprintf(w, "%s: %s # %s\n", f.Name, value, s.origins[f.Name])
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parseTestConfig parses the args into a config with
+// the given environment
+func parseTestConfig(t *testing.T, args []string, env map[string]string) (*SCPConfig, *flag.FlagSet, error) {
+	loadFile = ioutil.ReadFile
+	lookupEnv = func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	t.Cleanup(func() { lookupEnv = os.LookupEnv })
+
+	c := &SCPConfig{}
+	fs := flag.NewFlagSet("awsscp", flag.ContinueOnError)
+	c.setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("could not parse flags")
+	}
+	return c, fs, c.resolve(fs)
+}
+
+// TestEnvName tests the environment variable of a parameter
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "AWSSCP_UNKNOWN_SOURCE", envName("unknown-source"))
+	assert.Equal(t, configEnv, envName(configFlag))
+}
+
+// TestLoadConfig tests that config values are read
+// in their string form
+func TestLoadConfig(t *testing.T) {
+	values, err := loadConfig([]byte("threshold: 50\ncompact: true\ntype: Deny\ncatalog:\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"threshold": "50", "compact": "true", "type": "Deny", "catalog": ""}, values)
+
+	_, err = loadConfig([]byte("threshold: [50"))
+	assert.Error(t, err)
+
+	_, err = loadConfig([]byte("threshold:\n  s3: 50\n"))
+	assert.True(t, errors.Is(err, ErrInvalidConfigValue))
+}
+
+// TestResolvePrecedence tests that flags win over the
+// environment, which wins over the config file, which
+// wins over the defaults
+func TestResolvePrecedence(t *testing.T) {
+	c, _, err := parseTestConfig(t,
+		[]string{"-config", "./testdata/config.yaml", "-threshold", "5"},
+		map[string]string{"AWSSCP_STRATEGY": strategyTop, "AWSSCP_THRESHOLD": "7"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), c.Threshold)
+	assert.Equal(t, strategyTop, c.Strategy)
+	assert.Equal(t, "Deny", c.SCPType)
+	assert.True(t, c.Compact)
+	assert.Equal(t, mergeSum, c.Merge)
+	assert.Equal(t, oversizeError, c.Oversize)
+	assert.Equal(t, originFlag, c.origins["threshold"])
+	assert.Equal(t, originEnv, c.origins["strategy"])
+	assert.Equal(t, originFile, c.origins["type"])
+	assert.Equal(t, originDefault, c.origins["merge"])
+}
+
+// TestResolveConfigFromEnv tests that the config file
+// can be named by its environment variable
+func TestResolveConfigFromEnv(t *testing.T) {
+	c, _, err := parseTestConfig(t, nil, map[string]string{configEnv: "./testdata/config.yaml"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50), c.Threshold)
+	assert.Equal(t, originEnv, c.origins[configFlag])
+}
+
+// TestResolveErrors tests that unusable config files
+// and values are reported
+func TestResolveErrors(t *testing.T) {
+	unknownKey := writeTestConfig(t, "report: yes\n")
+	nestedConfig := writeTestConfig(t, "config: other.yaml\n")
+	invalidValue := writeTestConfig(t, "threshold: ten\n")
+	corrupt := writeTestConfig(t, "threshold: [10\n")
+
+	cases := []struct {
+		args     []string
+		env      map[string]string
+		expected error
+	}{
+		{args: []string{"-config", "./testdata/missing.yaml"}},
+		{args: []string{"-config", unknownKey}, expected: ErrUnknownConfigKey},
+		{args: []string{"-config", nestedConfig}, expected: ErrUnknownConfigKey},
+		{args: []string{"-config", invalidValue}},
+		{args: []string{"-config", corrupt}},
+		{env: map[string]string{"AWSSCP_FORCE": "maybe"}},
+	}
+
+	for _, c := range cases {
+		_, _, err := parseTestConfig(t, c.args, c.env)
+		assert.Error(t, err)
+		if c.expected != nil {
+			assert.True(t, errors.Is(err, c.expected))
+		}
+	}
+}
+
+// TestPrintConfig tests that every parameter is printed
+// with its effective value and origin
+func TestPrintConfig(t *testing.T) {
+	c, fs, _ := parseTestConfig(t, []string{"-config", "./testdata/config.yaml", "-force"}, nil)
+	var output bytes.Buffer
+
+	c.print(&output, fs)
+
+	assert.Contains(t, output.String(), "config: \"./testdata/config.yaml\" # flag\n")
+	assert.Contains(t, output.String(), "force: true # flag\n")
+	assert.Contains(t, output.String(), "threshold: 50 # file\n")
+	assert.Contains(t, output.String(), "unknown-source: \"warn\" # default\n")
+}
+
+// writeTestConfig writes a config file into a temporary directory
+func writeTestConfig(t *testing.T, config string) string {
+	file, _ := ioutil.TempFile(t.TempDir(), "config*.yaml")
+	file.WriteString(config)
+	file.Close()
+	return file.Name()
+}
+
+// TestResolveOutputFromFormat tests that the output file
+// is named after the format unless it was given
+func TestResolveOutputFromFormat(t *testing.T) {
+	cases := []struct {
+		args     []string
+		env      map[string]string
+		expected string
+	}{
+		{expected: defaultSCPFilename},
+		{args: []string{"-format", formatYAML}, expected: defaultSCPYAMLFilename},
+		{args: []string{"-format", formatTerraform}, expected: defaultTerraformFilename},
+		{args: []string{"-format", formatCloudFormation}, expected: defaultCloudFormationFilename},
+		{args: []string{"-format", formatCloudFormationJSON}, expected: defaultCloudFormationJSONFilename},
+		{args: []string{"-format", formatTerraform, "-out", "scp.json"}, expected: "scp.json"},
+		{env: map[string]string{"AWSSCP_FORMAT": formatTerraform, "AWSSCP_OUT": "-"}, expected: stdoutDestination},
+	}
+
+	for _, c := range cases {
+		config, _, err := parseTestConfig(t, c.args, c.env)
+
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, config.Output, c.args)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCSVHeader = errors.New("csv header must name the event_source, event_name and count columns")
+var ErrInvalidCSVRow = errors.New("csv row is not a valid api call")
+
+// CSV columns of an Athena query result
+const (
+	columnEventSource = "event_source"
+	columnEventName   = "event_name"
+	columnCount       = "count"
+	columnAccountID   = "account_id"
+	columnAccountName = "account_name"
+	columnYear        = "year"
+	columnMonth       = "month"
+)
+
+// csvColumns is the order of the columns of a CSV
+// file without a header
+var csvColumns = []string{columnEventSource, columnEventName, columnCount, columnAccountID, columnAccountName}
+
+// csvAliases maps other names Athena queries give the
+// columns to the names used here
+var csvAliases = map[string]string{
+	"eventsource":        columnEventSource,
+	"eventname":          columnEventName,
+	"account":            columnAccountID,
+	"account_identifier": columnAccountID,
+	"recipientaccountid": columnAccountID,
+	"name":               columnAccountName,
+}
+
+// csvIndex returns the position of each column named by
+// a header row, or false when the row is not a header.
+// A row is a header when its count column is not a number.
+func csvIndex(record []string) (map[string]int, bool, error) {
+	index := map[string]int{}
+	if len(record) > 2 {
+		if _, err := strconv.ParseInt(strings.TrimSpace(record[2]), 10, 64); err == nil {
+			for i := range record {
+				if i < len(csvColumns) {
+					index[csvColumns[i]] = i
+				}
+			}
+			return index, false, nil
+		}
+	}
+
+	for i, name := range record {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if alias, ok := csvAliases[name]; ok {
+			name = alias
+		}
+		if _, ok := index[name]; !ok {
+			index[name] = i
+		}
+	}
+	for _, required := range []string{columnEventSource, columnEventName, columnCount} {
+		if _, ok := index[required]; !ok {
+			return nil, true, ErrInvalidCSVHeader
+		}
+	}
+	return index, true, nil
+}
+
+// csvReportKey identifies the report of a CSV row
+type csvReportKey struct {
+	account string
+	year    string
+	month   string
+}
+
+// decodeCSV reads the rows of an Athena query result as
+// event_source, event_name and count columns, along with
+// optional account_id, account_name, year and month columns.
+// The columns are named by a header row when there is one
+// and taken in that order when there is not. The rows of
+// each account, year and month are handed to fn as a single
+// report, with the counts of repeated api calls summed.
+func decodeCSV(r io.Reader, fn func(Report)) error {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	var index map[string]int
+	var reports []*Report
+	var calls []map[apiCall]int
+	keys := map[csvReportKey]int{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if index == nil {
+			var header bool
+			if index, header, err = csvIndex(record); err != nil {
+				return err
+			}
+			if header {
+				continue
+			}
+		}
+
+		column := func(name string) string {
+			if i, ok := index[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		count, err := strconv.ParseInt(column(columnCount), 10, 64)
+		if err != nil || column(columnEventSource) == "" || column(columnEventName) == "" {
+			return fmt.Errorf("%w: line %d", ErrInvalidCSVRow, line)
+		}
+
+		key := csvReportKey{account: column(columnAccountID), year: column(columnYear), month: column(columnMonth)}
+		i, ok := keys[key]
+		if !ok {
+			report := &Report{Usage: []Usage{}}
+			report.Account.Identifier = key.account
+			report.Account.AccountName = column(columnAccountName)
+			report.Partition.Year = key.year
+			report.Partition.Month = key.month
+			i = len(reports)
+			keys[key] = i
+			reports = append(reports, report)
+			calls = append(calls, map[apiCall]int{})
+		}
+
+		report := reports[i]
+		call := apiCall{eventSource: column(columnEventSource), eventName: column(columnEventName)}
+		if j, ok := calls[i][call]; ok {
+			report.Usage[j].Count += count
+			continue
+		}
+		calls[i][call] = len(report.Usage)
+		report.Usage = append(report.Usage, Usage{EventSource: call.eventSource, EventName: call.eventName, Count: count})
+	}
+
+	for _, report := range reports {
+		fn(*report)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeTestCSV decodes a CSV query result into reports
+func decodeTestCSV(data string) ([]Report, error) {
+	var reports []Report
+	err := decodeCSV(strings.NewReader(data), func(r Report) {
+		reports = append(reports, r)
+	})
+	return reports, err
+}
+
+// TestDecodeCSVHeader tests that the columns are found by
+// the names in the header, whatever their order
+func TestDecodeCSVHeader(t *testing.T) {
+	reports, err := decodeTestCSV(`"count","eventName","eventSource","account","account_name","extra"
+"3","GetObject","s3.amazonaws.com","111111111111","platform","x"
+"2","Decrypt","kms.amazonaws.com","222222222222","webops","x"
+"5","PutObject","s3.amazonaws.com","111111111111","platform","x"
+`)
+
+	assert.Nil(t, err)
+	assert.Len(t, reports, 2)
+	assert.Equal(t, "111111111111", reports[0].Account.Identifier)
+	assert.Equal(t, "platform", reports[0].Account.AccountName)
+	assert.Equal(t, []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 3},
+		{EventSource: "s3.amazonaws.com", EventName: "PutObject", Count: 5},
+	}, reports[0].Usage)
+	assert.Equal(t, "222222222222", reports[1].Account.Identifier)
+	assert.Equal(t, []Usage{{EventSource: "kms.amazonaws.com", EventName: "Decrypt", Count: 2}}, reports[1].Usage)
+}
+
+// TestDecodeCSVNoHeader tests that the columns of a file
+// without a header are taken in their usual order
+func TestDecodeCSVNoHeader(t *testing.T) {
+	reports, err := decodeTestCSV("s3.amazonaws.com, GetObject, 3\ns3.amazonaws.com, PutObject, 5\n")
+
+	assert.Nil(t, err)
+	assert.Len(t, reports, 1)
+	assert.Equal(t, "", reports[0].Account.Identifier)
+	assert.Equal(t, []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 3},
+		{EventSource: "s3.amazonaws.com", EventName: "PutObject", Count: 5},
+	}, reports[0].Usage)
+
+	reports, err = decodeTestCSV("s3.amazonaws.com,GetObject,3,111111111111,platform\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "111111111111", reports[0].Account.Identifier)
+	assert.Equal(t, "platform", reports[0].Account.AccountName)
+}
+
+// TestDecodeCSVPartitions tests that each account, year
+// and month is a report of its own and that repeated api
+// calls within a report are summed
+func TestDecodeCSVPartitions(t *testing.T) {
+	reports, err := decodeTestCSV(`account_id,year,month,event_source,event_name,count
+111111111111,2021,03,s3.amazonaws.com,GetObject,3
+111111111111,2021,04,s3.amazonaws.com,GetObject,4
+111111111111,2021,03,s3.amazonaws.com,GetObject,5
+111111111111,2021,03,s3.amazonaws.com,PutObject,1
+`)
+
+	assert.Nil(t, err)
+	assert.Len(t, reports, 2)
+	assert.Equal(t, "03", reports[0].Partition.Month)
+	assert.Equal(t, []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 8},
+		{EventSource: "s3.amazonaws.com", EventName: "PutObject", Count: 1},
+	}, reports[0].Usage)
+	assert.Equal(t, "04", reports[1].Partition.Month)
+	assert.Equal(t, []Usage{{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 4}}, reports[1].Usage)
+}
+
+// TestDecodeCSVErrors tests that headers missing a
+// column and rows that are not api calls are rejected
+func TestDecodeCSVErrors(t *testing.T) {
+	_, err := decodeTestCSV("event_source,event_name,total\ns3.amazonaws.com,GetObject,3\n")
+	assert.Equal(t, ErrInvalidCSVHeader, err)
+
+	_, err = decodeTestCSV("event_source,event_name,count\ns3.amazonaws.com,GetObject,3\ns3.amazonaws.com,PutObject,many\n")
+	assert.True(t, errors.Is(err, ErrInvalidCSVRow))
+	assert.Contains(t, err.Error(), "line 3")
+
+	_, err = decodeTestCSV("event_source,event_name,count\n,GetObject,3\n")
+	assert.True(t, errors.Is(err, ErrInvalidCSVRow))
+
+	_, err = decodeTestCSV("event_source,event_name,count\ns3.amazonaws.com,GetObject\n")
+	assert.Error(t, err)
+}
+
+// TestDecodeUsageCSV tests that a CSV query result and
+// the scanner report it came from hold the same usage
+func TestDecodeUsageCSV(t *testing.T) {
+	csvData, _ := ioutil.ReadFile("./testdata/s3_usage.csv")
+	jsonData, _ := ioutil.ReadFile("./testdata/s3_scanner_report.json")
+
+	csvReports, err := decodeTestReports(csvData)
+	jsonReports, _ := decodeTestReports(jsonData)
+
+	assert.Nil(t, err)
+	assert.Len(t, *csvReports, 1)
+	assert.Equal(t, (*jsonReports)[0].Usage, (*csvReports)[0].Usage)
+	assert.Equal(t, (*jsonReports)[0].Account, (*csvReports)[0].Account)
+	assert.Equal(t, (*jsonReports)[0].Partition, (*csvReports)[0].Partition)
+}
+
+// TestRunCSVDirectory tests that CSV and JSON files in a
+// directory are merged into one SCP
+func TestRunCSVDirectory(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"account1.json": getScannerReport("111111111111", "GetObject"),
+		"account2.csv":  "account_id,event_source,event_name,count\n222222222222,s3.amazonaws.com,PutObject,20\n",
+	})
+	c := getTestSCPConfig(t, directory)
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, []string{"s3:GetObject", "s3:PutObject"}, []string(scp.Statement[0].Action))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrPolicyChanged = errors.New("policy has changed")
+
+// policyDiff is what changes when an existing policy
+// is replaced by a generated one
+type policyDiff struct {
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	EffectBefore string   `json:"effect_before"`
+	EffectAfter  string   `json:"effect_after"`
+	SizeBefore   int      `json:"size_before"`
+	SizeAfter    int      `json:"size_after"`
+	SizeDelta    int      `json:"size_delta"`
+}
+
+// diffSCP compares the actions, effects and size of two
+// policies. Actions are compared regardless of case.
+func diffSCP(before SCP, after SCP) policyDiff {
+	beforeActions, afterActions := policyActions(before), policyActions(after)
+	d := policyDiff{
+		Added:        []string{},
+		Removed:      []string{},
+		EffectBefore: policyEffect(before),
+		EffectAfter:  policyEffect(after),
+		SizeBefore:   scpSize(before),
+		SizeAfter:    scpSize(after),
+	}
+	d.SizeDelta = d.SizeAfter - d.SizeBefore
+
+	for key, action := range afterActions {
+		if _, ok := beforeActions[key]; !ok {
+			d.Added = append(d.Added, action)
+		}
+	}
+	for key, action := range beforeActions {
+		if _, ok := afterActions[key]; !ok {
+			d.Removed = append(d.Removed, action)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// policyActions returns every action of a policy keyed
+// by its lower case spelling
+func policyActions(scp SCP) map[string]string {
+	actions := map[string]string{}
+	for _, statement := range scp.Statement {
+		for _, action := range statement.Action {
+			actions[strings.ToLower(action)] = action
+		}
+	}
+	return actions
+}
+
+// policyEffect returns the effects used by the
+// statements of a policy
+func policyEffect(scp SCP) string {
+	seen := map[string]bool{}
+	var effects []string
+	for _, statement := range scp.Statement {
+		if !seen[statement.Effect] {
+			seen[statement.Effect] = true
+			effects = append(effects, statement.Effect)
+		}
+	}
+	sort.Strings(effects)
+	return strings.Join(effects, ", ")
+}
+
+// changed reports whether the actions or effect differ
+func (d policyDiff) changed() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || d.EffectBefore != d.EffectAfter
+}
+
+// write writes the diff in a human readable form, with
+// added actions marked + and removed actions -
+func (d policyDiff) write(w io.Writer) {
+	if d.EffectBefore != d.EffectAfter {
+		fmt.Fprintf(w, "effect: %s -> %s\n", d.EffectBefore, d.EffectAfter)
+	} else {
+		fmt.Fprintf(w, "effect: %s\n", d.EffectAfter)
+	}
+	for _, action := range d.Added {
+		fmt.Fprintf(w, "+ %s\n", action)
+	}
+	for _, action := range d.Removed {
+		fmt.Fprintf(w, "- %s\n", action)
+	}
+	fmt.Fprintf(w, "size: %d -> %d (%+d)\n", d.SizeBefore, d.SizeAfter, d.SizeDelta)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDiffSCP tests that added and removed actions,
+// effect changes and the size delta are found
+func TestDiffSCP(t *testing.T) {
+	before := generateSCP("Allow", permissions{"s3": {"GetObject": 1, "ListBucket": 1}}, sortByName, nil)
+	after := generateSCP("Deny", permissions{"s3": {"getobject": 1, "PutObject": 1}, "kms": {"Decrypt": 1}}, sortByName, nil)
+
+	d := diffSCP(before, after)
+
+	assert.Equal(t, []string{"kms:Decrypt", "s3:PutObject"}, d.Added)
+	assert.Equal(t, []string{"s3:ListBucket"}, d.Removed)
+	assert.Equal(t, "Allow", d.EffectBefore)
+	assert.Equal(t, "Deny", d.EffectAfter)
+	assert.Equal(t, scpSize(after)-scpSize(before), d.SizeDelta)
+	assert.True(t, d.changed())
+}
+
+// TestDiffSCPUnchanged tests that reordered actions
+// and statements are not a change
+func TestDiffSCPUnchanged(t *testing.T) {
+	before := SCP{Version: policyVersion, Statement: Statements{
+		{Effect: "Deny", Action: StringList{"s3:PutObject"}},
+		{Effect: "Allow", Action: StringList{"s3:GetObject", "kms:Decrypt"}},
+	}}
+	after := SCP{Version: policyVersion, Statement: Statements{
+		{Effect: "Allow", Action: StringList{"kms:Decrypt", "s3:GetObject"}},
+		{Effect: "Deny", Action: StringList{"s3:PutObject"}},
+	}}
+
+	d := diffSCP(before, after)
+
+	assert.Equal(t, "Allow, Deny", d.EffectAfter)
+	assert.False(t, d.changed())
+}
+
+// TestDiffWrite tests the human readable diff
+func TestDiffWrite(t *testing.T) {
+	var output bytes.Buffer
+	d := policyDiff{Added: []string{"s3:PutObject"}, Removed: []string{"s3:ListBucket"},
+		EffectBefore: "Allow", EffectAfter: "Deny", SizeBefore: 150, SizeAfter: 140, SizeDelta: -10}
+
+	d.write(&output)
+
+	assert.Equal(t, "effect: Allow -> Deny\n+ s3:PutObject\n- s3:ListBucket\nsize: 150 -> 140 (-10)\n", output.String())
+
+	output.Reset()
+	policyDiff{EffectBefore: "Allow", EffectAfter: "Allow", SizeBefore: 150, SizeAfter: 150}.write(&output)
+	assert.Equal(t, "effect: Allow\nsize: 150 -> 150 (+0)\n", output.String())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// eventSourceData is the bundled CloudTrail event source
+// to iam service prefix mapping
+//
+//go:embed data/event_sources.json
+var eventSourceData []byte
+
+// Unknown event source handling modes
+const (
+	unknownSourceWarn  = "warn"
+	unknownSourceError = "error"
+)
+
+var ErrUnknownEventSource = errors.New("unknown event source")
+var ErrInvalidUnknownSourceMode = errors.New("unknown source mode must be warn or error")
+
+// eventSourceMap maps a CloudTrail event source to
+// the iam prefix of its service
+type eventSourceMap map[string]string
+
+// defaultEventSources is the mapping bundled with the binary
+var defaultEventSources = mustLoadEventSources(eventSourceData)
+
+// loadEventSources decodes an event source mapping
+func loadEventSources(jsonData []byte) (eventSourceMap, error) {
+	sources := eventSourceMap{}
+	if err := json.Unmarshal(jsonData, &sources); err != nil {
+		return nil, err
+	}
+
+	normalised := eventSourceMap{}
+	for eventSource, prefix := range sources {
+		normalised[strings.ToLower(eventSource)] = prefix
+	}
+	return normalised, nil
+}
+
+func mustLoadEventSources(jsonData []byte) eventSourceMap {
+	sources, err := loadEventSources(jsonData)
+	if err != nil {
+		panic(err)
+	}
+	return sources
+}
+
+// merge returns a copy of the mapping with the
+// overrides added or replacing existing entries
+func (m eventSourceMap) merge(overrides eventSourceMap) eventSourceMap {
+	merged := eventSourceMap{}
+	for eventSource, prefix := range m {
+		merged[eventSource] = prefix
+	}
+	for eventSource, prefix := range overrides {
+		merged[eventSource] = prefix
+	}
+	return merged
+}
+
+// serviceName returns the iam prefix of the service
+// behind a CloudTrail event source
+func (m eventSourceMap) serviceName(eventSource string) (string, bool) {
+	prefix, ok := m[strings.ToLower(eventSource)]
+	return prefix, ok
+}
+
+// unknownSources returns the event sources in the
+// usage that have no mapping
+func (m eventSourceMap) unknownSources(usage []Usage) []string {
+	seen := map[string]bool{}
+	var unknown []string
+	for _, u := range usage {
+		if _, ok := m.serviceName(u.EventSource); ok || seen[u.EventSource] {
+			continue
+		}
+		seen[u.EventSource] = true
+		unknown = append(unknown, u.EventSource)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDefaultEventSources tests that every event source
+// in the role usage test data is mapped
+func TestDefaultEventSources(t *testing.T) {
+	testData := getRoleUsageReport()
+	assert.Empty(t, defaultEventSources.unknownSources(testData.Usage))
+	assert.Panics(t, func() { mustLoadEventSources([]byte(`{`)) })
+}
+
+// TestMergeEventSources tests that user entries are
+// added to and replace the bundled entries
+func TestMergeEventSources(t *testing.T) {
+	overrides, err := loadEventSources([]byte(`{"S3.amazonaws.com": "s3-custom", "new.amazonaws.com": "new"}`))
+	assert.Nil(t, err)
+
+	merged := defaultEventSources.merge(overrides)
+
+	assert.Equal(t, "s3-custom", merged["s3.amazonaws.com"])
+	assert.Equal(t, "new", merged["new.amazonaws.com"])
+	assert.Equal(t, "cloudwatch", merged["monitoring.amazonaws.com"])
+	assert.Equal(t, "s3", defaultEventSources["s3.amazonaws.com"])
+}
+
+// TestUnknownSources tests that each unmapped event
+// source is reported once
+func TestUnknownSources(t *testing.T) {
+	usage := []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject"},
+		{EventSource: "unknown.amazonaws.com", EventName: "GetThing"},
+		{EventSource: "unknown.amazonaws.com", EventName: "PutThing"},
+		{EventSource: "another.amazonaws.com", EventName: "GetThing"},
+	}
+	assert.Equal(t, []string{"another.amazonaws.com", "unknown.amazonaws.com"}, defaultEventSources.unknownSources(usage))
+}
+
+// TestGenerateListSkipsUnknownSources tests that api calls
+// from unmapped event sources are left out
+func TestGenerateListSkipsUnknownSources(t *testing.T) {
+	report := Report{Usage: []Usage{
+		{EventSource: "monitoring.amazonaws.com", EventName: "DescribeAlarms", Count: 5},
+		{EventSource: "unknown.amazonaws.com", EventName: "GetThing", Count: 5},
+	}}
+
+	allowList := generateList(strategySet{fallback: countStrategy{threshold: 1}}, &report, defaultEventSources)
+
+	assert.Equal(t, permissions{"cloudwatch": {"DescribeAlarms": 5}}, allowList)
+}
+
+// TestGetEventSources tests that a user file is
+// merged with the bundled mapping
+func TestGetEventSources(t *testing.T) {
+	defer func() { loadFile = ioutil.ReadFile }()
+	testSCPRun := getTestSCPRun()
+	err := testSCPRun.getEventSources()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultEventSources, testSCPRun.sources)
+
+	loadFile = func(filename string) ([]byte, error) {
+		return []byte(`{"custom.example.com": "custom"}`), nil
+	}
+	testSCPRun.sourcesFilename = "sources.json"
+	err = testSCPRun.getEventSources()
+	assert.Nil(t, err)
+	assert.Equal(t, "custom", testSCPRun.sources["custom.example.com"])
+	assert.Equal(t, "s3", testSCPRun.sources["s3.amazonaws.com"])
+
+	loadFile = func(filename string) ([]byte, error) {
+		return []byte(`["custom"]`), nil
+	}
+	assert.Error(t, testSCPRun.getEventSources())
+
+	loadFile = func(filename string) ([]byte, error) {
+		return nil, ErrInvalidParameters
+	}
+	assert.Equal(t, ErrInvalidParameters, testSCPRun.getEventSources())
+}
+
+// TestCheckEventSources tests that unmapped event sources
+// produce a warning or an error
+func TestCheckEventSources(t *testing.T) {
+	usage := []Usage{{EventSource: "unknown.amazonaws.com", EventName: "GetThing", Count: 5}}
+	messages := captureStderr(t)
+
+	testSCPRun := getTestSCPRun()
+	assert.Nil(t, testSCPRun.checkEventSources(usage))
+	assert.Equal(t, "warning: unknown event source unknown.amazonaws.com, its api calls are left out\n", messages.String())
+
+	testSCPRun.unknownSource = unknownSourceError
+	err := testSCPRun.checkEventSources(usage)
+	assert.True(t, errors.Is(err, ErrUnknownEventSource))
+	assert.Contains(t, err.Error(), "unknown.amazonaws.com")
+
+	testSCPRun.unknownSource = "ignore"
+	assert.Equal(t, ErrInvalidUnknownSourceMode, testSCPRun.checkEventSources(usage))
+}
+
+// TestCreatePermissionsUnknownSourceError tests that the
+// error mode stops permissions being created
+func TestCreatePermissionsUnknownSourceError(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.unknownSource = unknownSourceError
+	reports := []Report{{Usage: []Usage{{EventSource: "unknown.amazonaws.com", EventName: "GetThing", Count: 50}}}}
+	testSCPRun.usage = aggregateReports(reports)
+
+	err := testSCPRun.createPermissions()
+
+	assert.True(t, errors.Is(err, ErrUnknownEventSource))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+// decision records why an api call did or did not
+// end up in the SCP
+type decision struct {
+	Service     string   `json:"service,omitempty"`
+	EventSource string   `json:"event_source"`
+	Action      string   `json:"action"`
+	EventNames  []string `json:"event_names,omitempty"`
+	Count       int64    `json:"count"`
+	Strategy    string   `json:"strategy"`
+	Threshold   int64    `json:"threshold"`
+	Selected    bool     `json:"selected"`
+	Override    string   `json:"override,omitempty"`
+	Included    bool     `json:"included"`
+	InPolicyAs  string   `json:"in_policy_as,omitempty"`
+}
+
+// explainPermissions returns a decision for every iam
+// action in the translated usage, naming the event names
+// of the calls that need it, along with the actions a
+// baseline added that were not used at all. Included shows
+// whether the action is in the final permissions, until
+// matchPolicy checks it against the generated policy.
+func explainPermissions(strategies strategySet, reportData *Report, sources eventSourceMap, overrides []override, final permissions) []decision {
+	reasons := map[string]string{}
+	for _, o := range overrides {
+		reasons[strings.ToLower(o.Action)] = o.explanation()
+	}
+	services := serviceUsages(reportData, sources)
+
+	var decisions []decision
+	explained := map[string]bool{}
+	for _, v := range reportData.Usage {
+		d := decision{EventSource: v.EventSource, Action: v.EventName, EventNames: v.EventNames, Count: v.Count}
+		service, ok := sources.serviceName(v.EventSource)
+		if !ok {
+			d.Override = "unknown event source"
+			decisions = append(decisions, d)
+			continue
+		}
+
+		d.Service = service
+		d.Action = service + ":" + v.EventName
+		strategy := strategies.strategyFor(service, v.EventName)
+		d.Strategy, d.Threshold = strategy.describe()
+		d.Selected = strategy.selects(v.Count, services[service])
+		d.Override = reasons[strings.ToLower(d.Action)]
+		_, d.Included = final[service][v.EventName]
+		explained[strings.ToLower(d.Action)] = true
+		decisions = append(decisions, d)
+	}
+
+	for _, o := range overrides {
+		if o.Included && !explained[strings.ToLower(o.Action)] {
+			decisions = append(decisions, decision{Service: strings.SplitN(o.Action, ":", 2)[0], Action: o.Action, Override: o.explanation(), Included: true})
+		}
+	}
+	return decisions
+}
+
+// matchPolicy sets whether each decision's action is in
+// the policy documents that were generated, along with the
+// action or wildcard of the policy that covers it, so the
+// decisions match the policy once it has been compacted
+func matchPolicy(decisions []decision, documents []SCP) []decision {
+	for i, d := range decisions {
+		decisions[i].Included, decisions[i].InPolicyAs = false, ""
+		for _, scp := range documents {
+			for _, statement := range scp.Statement {
+				for _, action := range statement.Action {
+					if ok, _ := path.Match(strings.ToLower(action), strings.ToLower(d.Action)); ok && !decisions[i].Included {
+						decisions[i].Included, decisions[i].InPolicyAs = true, action
+					}
+				}
+			}
+		}
+	}
+	return decisions
+}
+
+// outcome says whether the action is in the SCP, naming
+// the wildcard it is covered by when it was compacted
+func (d decision) outcome() string {
+	if !d.Included {
+		return "left out"
+	}
+	if d.InPolicyAs != "" && !strings.EqualFold(d.InPolicyAs, d.Action) {
+		return "in scp as " + d.InPolicyAs
+	}
+	return "in scp"
+}
+
+// eventNames lists the event names of the calls that
+// need the action, or - when there are none
+func (d decision) eventNames() string {
+	if len(d.EventNames) == 0 {
+		return "-"
+	}
+	return strings.Join(d.EventNames, ", ")
+}
+
+// writeDecisions writes the decisions as a table
+func writeDecisions(w io.Writer, decisions []decision) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tEVENT NAMES\tCOUNT\tSTRATEGY\tTHRESHOLD\tSELECTED\tOUTCOME\tOVERRIDE")
+	for _, d := range decisions {
+		strategy, threshold, selected := "-", "-", "-"
+		if d.Strategy != "" {
+			strategy = d.Strategy
+			threshold = fmt.Sprint(d.Threshold)
+			selected = yesNo(d.Selected)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", d.Action, d.eventNames(), d.Count, strategy, threshold, selected, d.outcome(), d.Override)
+	}
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestExplainPermissions tests that every api call gets
+// a decision along with the unused baseline actions
+func TestExplainPermissions(t *testing.T) {
+	report := defaultCatalog.translateUsage(&Report{Usage: []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 231},
+		{EventSource: "s3.amazonaws.com", EventName: "ListBuckets", Count: 145},
+		{EventSource: "s3.amazonaws.com", EventName: "GetBucketNotification", Count: 1},
+		{EventSource: "unknown.amazonaws.com", EventName: "GetThing", Count: 5},
+	}}, defaultEventSources)
+	strategies := strategySet{fallback: countStrategy{threshold: 10}}
+	p := generateList(strategies, report, defaultEventSources)
+	overrides := applyBaselines(p, calledAs(report, defaultEventSources),
+		baseline{{Action: "sts:AssumeRole", Reason: "break glass access"}}, listBaseline,
+		baseline{{Action: "s3:ListBuckets"}}, listNever)
+
+	decisions := explainPermissions(strategies, report, defaultEventSources, overrides, p)
+
+	assert.Equal(t, []decision{
+		{Service: "s3", EventSource: "s3.amazonaws.com", Action: "s3:GetObject", EventNames: []string{"GetObject"}, Count: 231, Strategy: strategyCount, Threshold: 10, Selected: true, Included: true},
+		{Service: "s3", EventSource: "s3.amazonaws.com", Action: "s3:ListAllMyBuckets", EventNames: []string{"ListBuckets"}, Count: 145, Strategy: strategyCount, Threshold: 10, Selected: true, Override: "excluded by the never allow list"},
+		{Service: "s3", EventSource: "s3.amazonaws.com", Action: "s3:GetBucketNotification", EventNames: []string{"GetBucketNotification"}, Count: 1, Strategy: strategyCount, Threshold: 10},
+		{EventSource: "unknown.amazonaws.com", Action: "GetThing", EventNames: []string{"GetThing"}, Count: 5, Override: "unknown event source"},
+		{Service: "sts", Action: "sts:AssumeRole", Override: "included by the baseline: break glass access", Included: true},
+	}, decisions)
+}
+
+// TestExplainDenyPermissions tests that a deny decision
+// records the inverted strategy
+func TestExplainDenyPermissions(t *testing.T) {
+	report := Report{Usage: []Usage{{EventSource: "s3.amazonaws.com", EventName: "GetBucketNotification", Count: 1}}}
+	strategies := strategySet{fallback: countStrategy{threshold: 10}}.invert()
+	p := generateList(strategies, &report, defaultEventSources)
+
+	decisions := explainPermissions(strategies, &report, defaultEventSources, nil, p)
+
+	assert.Equal(t, "not count", decisions[0].Strategy)
+	assert.True(t, decisions[0].Selected)
+	assert.True(t, decisions[0].Included)
+}
+
+// TestMatchPolicy tests that decisions are matched with
+// the actions and wildcards of the compacted policy
+func TestMatchPolicy(t *testing.T) {
+	decisions := []decision{
+		{Action: "s3:GetObject", Included: true},
+		{Action: "s3:GetBucketPolicy", Included: true},
+		{Action: "kms:Decrypt", Included: true},
+		{Action: "s3:PutObject"},
+	}
+	documents := []SCP{
+		{Statement: Statements{{Action: StringList{"s3:Get*"}}}},
+		{Statement: Statements{{Action: StringList{"KMS:decrypt"}}}},
+	}
+
+	matched := matchPolicy(decisions, documents)
+
+	assert.Equal(t, []decision{
+		{Action: "s3:GetObject", Included: true, InPolicyAs: "s3:Get*"},
+		{Action: "s3:GetBucketPolicy", Included: true, InPolicyAs: "s3:Get*"},
+		{Action: "kms:Decrypt", Included: true, InPolicyAs: "KMS:decrypt"},
+		{Action: "s3:PutObject"},
+	}, matched)
+	assert.Equal(t, "in scp as s3:Get*", matched[0].outcome())
+	assert.Equal(t, "in scp", matched[2].outcome())
+	assert.Equal(t, "left out", matched[3].outcome())
+}
+
+// TestWriteDecisions tests the decision table
+func TestWriteDecisions(t *testing.T) {
+	var output bytes.Buffer
+
+	err := writeDecisions(&output, []decision{
+		{Action: "s3:GetObject", EventNames: []string{"GetObject", "CopyObject"}, Count: 231, Strategy: strategyTop, Threshold: 1, Selected: true, Included: true},
+		{Action: "GetThing", Count: 5, Override: "unknown event source"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ""+
+		"ACTION        EVENT NAMES            COUNT  STRATEGY  THRESHOLD  SELECTED  OUTCOME   OVERRIDE\n"+
+		"s3:GetObject  GetObject, CopyObject  231    top       1          yes       in scp    \n"+
+		"GetThing      -                      5      -         -          -         left out  unknown event source\n",
+		output.String())
+}
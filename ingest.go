@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ErrNoScannerReports is returned when a directory or glob
+// location yields no usable scanner report
+var ErrNoScannerReports = errors.New("no scanner reports found")
+
+// errNotReportFile is the reason files without a .json
+// or .csv extension are left out of a directory
+var errNotReportFile = errors.New("not a .json or .csv file, gzipped or not")
+
+// gzipMagic starts every gzip compressed file
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// scannerInput is a scanner report file, along with
+// its data once opened
+type scannerInput struct {
+	filename string
+	data     io.ReadCloser
+}
+
+// skippedFile records a scanner file left out of the
+// usage dataset and the reason why
+type skippedFile struct {
+	filename string
+	reason   error
+}
+
+// isGlob reports whether a location is a glob pattern
+func isGlob(location string) bool {
+	return strings.ContainsAny(location, "*?[")
+}
+
+// scannerFiles resolves a scanner file location into the
+// files to load. A location is a single file, - for stdin,
+// a directory or a glob pattern. Directories contribute
+// their .json and .csv files, along with gzipped ones such
+// as the .json.gz files CloudTrail delivers, descending into
+// sub directories when recursive is set. Other files are
+// returned as skipped. The multiple result is false when
+// the location is a single file, whose errors are fatal.
+func scannerFiles(location string, recursive bool) ([]string, []skippedFile, bool, error) {
+	if location == stdinSource {
+		return []string{location}, nil, false, nil
+	}
+	if isGlob(location) {
+		matches, err := filepath.Glob(location)
+		if err != nil {
+			return nil, nil, true, err
+		}
+
+		var files []string
+		var skipped []skippedFile
+		for _, match := range matches {
+			if isDir, _ := directoryCheck(match); isDir {
+				dirFiles, dirSkipped, err := directoryFiles(match, recursive)
+				if err != nil {
+					return nil, nil, true, err
+				}
+				files = append(files, dirFiles...)
+				skipped = append(skipped, dirSkipped...)
+				continue
+			}
+			files = append(files, match)
+		}
+		return files, skipped, true, nil
+	}
+
+	if isDir, _ := directoryCheck(location); isDir {
+		files, skipped, err := directoryFiles(location, recursive)
+		return files, skipped, true, err
+	}
+	return []string{location}, nil, false, nil
+}
+
+// directoryFiles lists the usage files of a directory
+// in lexical order
+func directoryFiles(directory string, recursive bool) ([]string, []skippedFile, error) {
+	var files []string
+	var skipped []skippedFile
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != directory && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isUsageFile(path) {
+			skipped = append(skipped, skippedFile{filename: path, reason: errNotReportFile})
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, skipped, nil
+}
+
+// isUsageFile reports whether a file in a directory holds
+// usage, going by its extension
+func isUsageFile(path string) bool {
+	ext := filepath.Ext(strings.TrimSuffix(strings.ToLower(path), ".gz"))
+	return ext == ".json" || ext == ".csv"
+}
+
+// firstByte peeks past any leading whitespace, returning
+// 0 when there is nothing else
+func firstByte(r *bufio.Reader) byte {
+	for n := 1; ; n++ {
+		peeked, _ := r.Peek(n)
+		if len(peeked) < n {
+			return 0
+		}
+		if c := peeked[n-1]; !unicode.IsSpace(rune(c)) {
+			return c
+		}
+	}
+}
+
+// decodeUsage decodes a scanner file holding JSON scanner
+// reports, a CSV Athena query result or a CloudTrail log
+// file, decompressing it first when it is gzipped. Scanner
+// reports are an array and CloudTrail logs an object, so
+// anything else is taken to be CSV.
+func decodeUsage(r io.Reader, fn func(Report)) error {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		buffered = bufio.NewReader(decompressed)
+	}
+
+	switch firstByte(buffered) {
+	case '{':
+		return decodeCloudTrail(buffered, fn)
+	case '[', 0:
+		return decodeReports(buffered, fn)
+	default:
+		return decodeCSV(buffered, fn)
+	}
+}
+
+// skip records a file left out of the usage dataset
+// and warns about it
+func (s *SCPRun) skip(filename string, reason error) {
+	s.skipped = append(s.skipped, skippedFile{filename: filename, reason: reason})
+	fmt.Fprintf(stderr, "warning: skipped %s, %v\n", filename, reason)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeScannerDirectory lays out scanner files in a
+// temporary directory, keyed by their relative path
+func writeScannerDirectory(t *testing.T, files map[string]string) string {
+	directory := t.TempDir()
+	for name, content := range files {
+		filename := filepath.Join(directory, name)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		ioutil.WriteFile(filename, []byte(content), 0644)
+	}
+	return directory
+}
+
+// getScannerReport returns a service_usage report for an
+// account with a single s3 event
+func getScannerReport(account string, eventName string) string {
+	return `[{"account": {"identifier": "` + account + `"}, "results": {"event_source": "s3.amazonaws.com",
+		"service_usage": [{"event_name": "` + eventName + `", "count": 20}]}}]`
+}
+
+// TestScannerFilesSingleFile tests a file location
+// resolves to itself
+func TestScannerFilesSingleFile(t *testing.T) {
+	files, skipped, multiple, err := scannerFiles("./testdata/s3_usage.json", false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"./testdata/s3_usage.json"}, files)
+	assert.Empty(t, skipped)
+	assert.False(t, multiple)
+}
+
+// TestScannerFilesDirectory tests a directory resolves to
+// its json files, skipping other files and sub directories
+func TestScannerFilesDirectory(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"b.json":        "[]",
+		"a.json":        "[]",
+		"notes.txt":     "notes",
+		"nested/c.json": "[]",
+	})
+
+	files, skipped, multiple, err := scannerFiles(directory, false)
+
+	assert.Nil(t, err)
+	assert.True(t, multiple)
+	assert.Equal(t, []string{filepath.Join(directory, "a.json"), filepath.Join(directory, "b.json")}, files)
+	assert.Equal(t, []skippedFile{{filename: filepath.Join(directory, "notes.txt"), reason: errNotReportFile}}, skipped)
+}
+
+// TestScannerFilesRecursive tests sub directories are
+// searched when recursive is set
+func TestScannerFilesRecursive(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"a.json":             "[]",
+		"nested/c.json":      "[]",
+		"nested/deep/d.JSON": "[]",
+	})
+
+	files, _, _, err := scannerFiles(directory, true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(directory, "a.json"),
+		filepath.Join(directory, "nested", "c.json"),
+		filepath.Join(directory, "nested", "deep", "d.JSON"),
+	}, files)
+}
+
+// TestScannerFilesGlob tests a glob pattern resolves to
+// the files it matches
+func TestScannerFilesGlob(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"s3_usage.json":  "[]",
+		"kms_usage.json": "[]",
+		"other.json":     "[]",
+	})
+
+	files, _, multiple, err := scannerFiles(filepath.Join(directory, "*_usage.json"), false)
+
+	assert.Nil(t, err)
+	assert.True(t, multiple)
+	assert.Equal(t, []string{filepath.Join(directory, "kms_usage.json"), filepath.Join(directory, "s3_usage.json")}, files)
+}
+
+// TestGetReportMergesDirectory tests the reports of every
+// file in a directory are loaded and invalid files skipped
+func TestGetReportMergesDirectory(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"account1.json": getScannerReport("111111111111", "GetObject"),
+		"account2.json": getScannerReport("222222222222", "PutObject"),
+		"broken.json":   "{not json",
+		"scp.json":      `{"Version": "2012-10-17", "Statement": []}`,
+		"empty.json":    `[{"results": {}}]`,
+	})
+	testSCPRun := getTestSCPRun()
+	testSCPRun.scannerFilename = directory
+	messages := captureStderr(t)
+
+	usageErr := testSCPRun.getUsageData()
+	reportErr := testSCPRun.getReport()
+
+	assert.Nil(t, usageErr)
+	assert.Nil(t, reportErr)
+	assert.Len(t, testSCPRun.usage.accounts, 2)
+	assert.Len(t, testSCPRun.skipped, 3)
+	assert.Equal(t, ErrUnknownReportFormat, testSCPRun.skipped[1].reason)
+	assert.Contains(t, messages.String(), "warning: skipped "+filepath.Join(directory, "broken.json"))
+	assert.Contains(t, messages.String(), "loaded 2 scanner files, skipped 3")
+}
+
+// TestGetReportSingleFileInvalid tests an invalid file
+// given on its own is still an error
+func TestGetReportSingleFileInvalid(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{"broken.json": "{not json"})
+	testSCPRun := getTestSCPRun()
+	testSCPRun.scannerFilename = filepath.Join(directory, "broken.json")
+
+	usageErr := testSCPRun.getUsageData()
+	reportErr := testSCPRun.getReport()
+
+	assert.Nil(t, usageErr)
+	assert.NotNil(t, reportErr)
+	assert.Empty(t, testSCPRun.skipped)
+}
+
+// TestGetUsageDataNoReports tests an error is returned when
+// a location holds no scanner files
+func TestGetUsageDataNoReports(t *testing.T) {
+	cases := []string{
+		writeScannerDirectory(t, map[string]string{"notes.txt": "notes"}),
+		filepath.Join(t.TempDir(), "*.json"),
+	}
+
+	for _, location := range cases {
+		testSCPRun := getTestSCPRun()
+		testSCPRun.scannerFilename = location
+
+		err := testSCPRun.getUsageData()
+
+		assert.True(t, errors.Is(err, ErrNoScannerReports), location)
+	}
+}
+
+// TestGetReportNoValidReports tests an error is returned when
+// none of the scanner files is a report
+func TestGetReportNoValidReports(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{"broken.json": "{not json"})
+	testSCPRun := getTestSCPRun()
+	testSCPRun.scannerFilename = directory
+
+	testSCPRun.getUsageData()
+	err := testSCPRun.getReport()
+
+	assert.True(t, errors.Is(err, ErrNoScannerReports))
+}
+
+// TestRunScannerDirectory tests the pipeline end to end
+// against a directory of scanner reports
+func TestRunScannerDirectory(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"account1.json":        getScannerReport("111111111111", "GetObject"),
+		"nested/account2.json": getScannerReport("222222222222", "PutObject"),
+	})
+	c := getTestSCPConfig(t, directory)
+	c.Recursive = true
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, []string{"s3:GetObject", "s3:PutObject"}, []string(scp.Statement[0].Action))
+}
+
+// trackedFile counts the scanner files open at once
+type trackedFile struct {
+	io.ReadCloser
+	open *int
+}
+
+func (f trackedFile) Close() error {
+	*f.open--
+	return f.ReadCloser.Close()
+}
+
+// TestGetReportOpensOneFileAtATime tests that the files of
+// a directory are each closed before the next is opened
+func TestGetReportOpensOneFileAtATime(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"account1.json": getScannerReport("111111111111", "GetObject"),
+		"account2.json": getScannerReport("222222222222", "PutObject"),
+		"account3.json": getScannerReport("333333333333", "ListBuckets"),
+	})
+	open, mostOpen := 0, 0
+	openFile = func(filename string) (io.ReadCloser, error) {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		open++
+		if open > mostOpen {
+			mostOpen = open
+		}
+		return trackedFile{ReadCloser: file, open: &open}, nil
+	}
+	t.Cleanup(func() {
+		openFile = func(filename string) (io.ReadCloser, error) { return os.Open(filename) }
+	})
+	testSCPRun := getTestSCPRun()
+	testSCPRun.scannerFilename = directory
+
+	usageErr := testSCPRun.getUsageData()
+	reportErr := testSCPRun.getReport()
+
+	assert.Nil(t, usageErr)
+	assert.Nil(t, reportErr)
+	assert.Len(t, testSCPRun.usage.accounts, 3)
+	assert.Equal(t, 1, mostOpen)
+	assert.Equal(t, 0, open)
+}
+
+// TestRunScannerDirectoryOpenError tests that a file of a
+// directory that can not be opened stops the run as an
+// input error instead of being skipped
+func TestRunScannerDirectoryOpenError(t *testing.T) {
+	directory := writeScannerDirectory(t, map[string]string{
+		"account1.json": getScannerReport("111111111111", "GetObject"),
+		"account2.json": getScannerReport("222222222222", "PutObject"),
+	})
+	mockOpenFile(t, func(filename string) ([]byte, error) {
+		if filepath.Base(filename) == "account2.json" {
+			return nil, &os.PathError{Op: "open", Path: filename, Err: syscall.EMFILE}
+		}
+		return ioutil.ReadFile(filename)
+	})
+	c := getTestSCPConfig(t, directory)
+
+	err := run(c)
+
+	assert.True(t, errors.Is(err, syscall.EMFILE))
+	assert.Equal(t, exitInput, exitCode(err))
+	assert.NoFileExists(t, c.Output)
+}
@@ -5,28 +5,75 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// Exit codes for each class of failure
 const (
-	exitFail = 1
+	exitFail   = 1
+	exitUsage  = 2
+	exitInput  = 3
+	exitPolicy = 4
+	exitOutput = 5
+	exitDiff   = 6
 )
+
 type SCPRun struct {
 	scannerFilename string
-	serviceType string
-	serviceName string
-	thresholdLimit int64
-	usageData []byte
-	reports *[]Report
-	permissionSet map[string]int64
-	scp SCP
+	serviceType     string
+	thresholdLimit  int64
+	strategy        string
+	thresholdsFile  string
+	thresholds      thresholdConfig
+	baselineFile    string
+	neverFile       string
+	baseline        baseline
+	never           baseline
+	overrides       []override
+	decisions       []decision
+	reviewLocation  string
+	reviewFormat    string
+	format          string
+	content         string
+	details         policyDetails
+	mergeMode       string
+	outputLocation  string
+	force           bool
+	sortOrder       string
+	oversize        string
+	compact         bool
+	catalogFilename string
+	catalog         actionCatalog
+	sourcesFilename string
+	unknownSource   string
+	sources         eventSourceMap
+	recursive       bool
+	multipleInputs  bool
+	inputs          []scannerInput
+	skipped         []skippedFile
+	usage           *usageAggregator
+	permissionSet   permissions
+	scp             SCP
+	documents       []SCP
 }
 
 //Package level vars to allow patch testing
 type fileLoader func (filename string)([]byte,error)
+type fileWriter func(filename string, data []byte, perm os.FileMode) error
+type fileOpener func(filename string) (io.ReadCloser, error)
+
 var loadFile fileLoader = ioutil.ReadFile
+var writeFile fileWriter = ioutil.WriteFile
+var openFile fileOpener = func(filename string) (io.ReadCloser, error) { return os.Open(filename) }
+var stdin io.Reader = os.Stdin
+var stdout io.Writer = os.Stdout
+var stderr io.Writer = os.Stderr
 
 //validateService checks that the correct apply or
 //deny value was supplied.
@@ -34,144 +81,533 @@ func (s *SCPRun) validateService() (bool, error) {
 	if !checkSCPParameter(s.serviceType){
 		return false, ErrInvalidSCPType
 	}
+	s.serviceType = scpEffect(s.serviceType)
 	return true, nil
 }
 
+// getUsageData finds the scanner file, or every scanner
+// file when the location is a directory or glob. A single
+// file is opened straight away, while many are each opened
+// only when they are decoded so they are never all open at
+// once.
 func (s *SCPRun) getUsageData()error{
-	usageData, err :=loadScannerFile(s.scannerFilename)
+	filenames, skipped, multiple, err := scannerFiles(s.scannerFilename, s.recursive)
 	if err != nil {
 		return err
 	}
-	s.usageData = usageData
+	s.multipleInputs = multiple
+	s.inputs = nil
+	for _, f := range skipped {
+		s.skip(f.filename, f.reason)
+	}
+
+	for _, filename := range filenames {
+		input := scannerInput{filename: filename}
+		if !multiple {
+			if input.data, err = loadScannerFile(filename); err != nil {
+				return err
+			}
+		}
+		s.inputs = append(s.inputs, input)
+	}
+
+	if len(s.inputs) == 0 {
+		return fmt.Errorf("%w in %s", ErrNoScannerReports, s.scannerFilename)
+	}
 	return nil
 }
 
+// getReport streams the scanner files into one usage
+// dataset, opening, decoding and closing one file at a
+// time. Files that are not scanner reports are skipped
+// when there are many, but a file that can not be opened
+// stops the run rather than leave its usage out.
 func (s *SCPRun) getReport() error{
- 	r, err := generateReport(s.usageData)
- 	if err != nil {
- 		return err
- 	}
- 	s.reports = r
- 	return nil
-}
+	if len(s.inputs) == 0 {
+		return ErrNoScannerReports
+	}
 
-func (s *SCPRun) createPermissions() error{
-	type fnEval = func(int64, int64) bool
-	var apiFn fnEval
+	s.usage = newUsageAggregator()
+	loaded := 0
+	for _, input := range s.inputs {
+		if input.data == nil {
+			data, err := openFile(input.filename)
+			if err != nil {
+				return err
+			}
+			input.data = data
+		}
 
-	switch s.serviceType {
-	case "Allow":
-		apiFn = greaterThan
-	case "Deny":
-		apiFn = lessThan
+		fileUsage := newUsageAggregator()
+		err := decodeUsage(input.data, fileUsage.add)
+		input.data.Close()
+		if err != nil {
+			if !s.multipleInputs {
+				return err
+			}
+			s.skip(input.filename, err)
+			continue
+		}
+		s.usage.combine(fileUsage)
+		loaded++
 	}
+	s.inputs = nil
 
-	r := *s.reports
-	permissionSet, err := generateList(s.thresholdLimit,&r[0],apiFn)
-	if err != nil{
-		return err
+	if s.multipleInputs {
+		if loaded == 0 {
+			return fmt.Errorf("%w in %s", ErrNoScannerReports, s.scannerFilename)
+		}
+		fmt.Fprintf(stderr, "loaded %d scanner files, skipped %d\n", loaded, len(s.skipped))
 	}
-	s.permissionSet = permissionSet
 	return nil
 }
 
-func (s *SCPRun) formatServiceName() error {
-	r := *s.reports
-	u := &r[0].Results.Service
+// getCatalog loads the action catalog, falling back to
+// the bundled one when no catalog file was given
+func (s *SCPRun) getCatalog() error {
+	if s.catalogFilename == "" {
+		s.catalog = defaultCatalog
+		return nil
+	}
 
-	s.serviceName = serviceName(*u)
+	catalogData, err := loadFile(s.catalogFilename)
+	if err != nil {
+		return err
+	}
+	catalog, err := loadCatalog(catalogData)
+	if err != nil {
+		return err
+	}
+	s.catalog = catalog
 	return nil
 }
 
-func (s *SCPRun) createSCP() error {
-	s.scp =generateSCP(s.serviceType,s.serviceName,s.permissionSet)
+// getEventSources loads the event source mapping, adding
+// any entries from the user supplied file to the bundled ones
+func (s *SCPRun) getEventSources() error {
+	s.sources = defaultEventSources
+	if s.sourcesFilename == "" {
+		return nil
+	}
+
+	sourceData, err := loadFile(s.sourcesFilename)
+	if err != nil {
+		return err
+	}
+	overrides, err := loadEventSources(sourceData)
+	if err != nil {
+		return err
+	}
+	s.sources = defaultEventSources.merge(overrides)
 	return nil
 }
 
-func (s *SCPRun) saveSCP() error {
-	err := saveSCP(s.scp)
+// getThresholds loads the per service and per action
+// threshold rules when a thresholds file was given
+func (s *SCPRun) getThresholds() error {
+	if s.thresholdsFile == "" {
+		return nil
+	}
+
+	thresholdData, err := loadFile(s.thresholdsFile)
 	if err != nil {
 		return err
 	}
+	thresholds, err := loadThresholds(thresholdData)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.thresholdsFile, err)
+	}
+	s.thresholds = thresholds
 	return nil
 }
 
-func main() {
-	c := SCPConfig{}
-	c.setup()
-	flag.Parse()
+// getBaselines loads the actions that are always and
+// never allowed when their files were given
+func (s *SCPRun) getBaselines() error {
+	var err error
+	if s.baseline, err = loadBaselineFile(s.baselineFile); err != nil {
+		return err
+	}
+	if s.never, err = loadBaselineFile(s.neverFile); err != nil {
+		return err
+	}
+	return s.baseline.check(s.never, s.catalog)
+}
 
-	f := c.scannerFilename()
-	t := c.serviceType()
-	d := c.thresholdLimit()
+// loadBaselineFile loads a baseline, which is empty
+// when no file was given
+func loadBaselineFile(filename string) (baseline, error) {
+	if filename == "" {
+		return nil, nil
+	}
 
-	if err := run(f,t,d); err != nil {
-		fmt.Fprintln(os.Stderr, exitFail)
+	baselineData, err := loadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := loadBaseline(baselineData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
+	return entries, nil
 }
 
-//run is an abstraction function that allows
-//us to test codebase.
-func run(scannerFilename *string, serviceType *string, thresholdLimit *int64) error {
-	//Get Config
-	scpRun := SCPRun{scannerFilename: *scannerFilename,serviceType: *serviceType,
-		thresholdLimit: *thresholdLimit}
+// checkEventSources warns about, or fails on, event
+// sources that can not be mapped to an iam prefix
+func (s *SCPRun) checkEventSources(usage []Usage) error {
+	if s.unknownSource != unknownSourceWarn && s.unknownSource != unknownSourceError {
+		return ErrInvalidUnknownSourceMode
+	}
 
-	_, err :=scpRun.validateService()
+	unknown := s.sources.unknownSources(usage)
+	if len(unknown) > 0 && s.unknownSource == unknownSourceError {
+		return fmt.Errorf("%w: %s", ErrUnknownEventSource, strings.Join(unknown, ", "))
+	}
+	for _, eventSource := range unknown {
+		fmt.Fprintf(stderr, "warning: unknown event source %s, its api calls are left out\n", eventSource)
+	}
+	return nil
+}
+
+func (s *SCPRun) createPermissions() error{
+	strategies, err := newStrategySet(s.strategy, s.thresholdLimit, s.thresholds)
 	if err != nil {
 		return err
 	}
+	if s.serviceType == "Deny" {
+		strategies = strategies.invert()
+	}
 
-	err = scpRun.getReport()
-
+	merged, err := s.usage.merge(s.mergeMode)
 	if err != nil {
 		return err
 	}
 
-	err = scpRun.getUsageData()
-	if err != nil {
+	if err := s.checkEventSources(merged.Usage); err != nil {
 		return err
 	}
 
-	err = scpRun.createPermissions()
+	usage := s.catalog.translateUsage(merged, s.sources)
+	names := calledAs(usage, s.sources)
+	for _, action := range s.thresholds.unmatchedActions(names, s.catalog) {
+		fmt.Fprintf(stderr, "warning: thresholds rule %s matches no iam action\n", action)
+	}
+	s.permissionSet = generateList(strategies, usage, s.sources)
 
-	if err != nil {
-		return err
+	include, includeList, exclude, excludeList := s.baseline, listBaseline, s.never, listNever
+	if s.serviceType == "Deny" {
+		include, includeList, exclude, excludeList = s.never, listNever, s.baseline, listBaseline
+	}
+	s.overrides = applyBaselines(s.permissionSet, names, include, includeList, exclude, excludeList)
+	for _, o := range s.overrides {
+		fmt.Fprintln(stderr, o)
+	}
+	s.decisions = explainPermissions(strategies, usage, s.sources, s.overrides, s.permissionSet)
+	return nil
+}
+
+func (s *SCPRun) createSCP() error {
+	if !checkSortParameter(s.sortOrder) {
+		return ErrInvalidSortOrder
+	}
+	_, unknown := s.catalog.translate(s.permissionSet)
+	for _, action := range unknown {
+		fmt.Fprintf(stderr, "warning: %s is not in the action catalog\n", action)
+	}
+
+	s.scp = generateSCP(s.serviceType, s.permissionSet, s.sortOrder, s.catalog)
+	if s.compact {
+		s.scp = compactSCP(s.scp, s.catalog)
+	}
+	return nil
+}
+
+// fitSCP checks the SCP has actions and fits the AWS size
+// limit, compacting or splitting it when it is too large
+func (s *SCPRun) fitSCP() error {
+	if s.oversize != oversizeError && s.oversize != oversizeCompact && s.oversize != oversizeSplit {
+		return ErrInvalidOversizeMode
+	}
+	for _, statement := range s.scp.Statement {
+		if len(statement.Action) == 0 && len(statement.NotAction) == 0 {
+			return ErrEmptySCP
+		}
 	}
 
-	err = scpRun.formatServiceName()
+	if s.oversize == oversizeCompact && scpSize(s.scp) > maxSCPSize {
+		s.scp = compactSCP(s.scp, s.catalog)
+	}
 
+	s.documents = []SCP{s.scp}
+	if scpSize(s.scp) <= maxSCPSize {
+		return nil
+	}
+	if s.oversize != oversizeSplit {
+		return ErrSCPTooLarge
+	}
+
+	documents, err := splitSCP(s.scp, maxSCPSize)
 	if err != nil {
 		return err
 	}
+	s.documents = documents
+	return nil
+}
+
+func (s *SCPRun) saveSCP() error {
+	if s.format == formatTerraform {
+		data, err := renderTerraform(s.documents, s.details, s.content)
+		if err != nil {
+			return err
+		}
+		return writeNamedOutput(data, s.outputLocation, scpFilename(s.format), s.force)
+	}
+	if s.format == formatCloudFormation || s.format == formatCloudFormationJSON {
+		data, err := renderCloudFormation(s.documents, s.details, s.format)
+		if err != nil {
+			return err
+		}
+		return writeNamedOutput(data, s.outputLocation, scpFilename(s.format), s.force)
+	}
 
-	err = scpRun.createSCP()
+	if len(s.documents) > 1 {
+		return saveSplitSCP(s.documents, s.outputLocation, s.format, s.force)
+	}
 
+	err := saveSCP(s.scp, s.outputLocation, s.format, s.force)
 	if err != nil {
 		return err
 	}
+	return nil
+}
 
-	err = scpRun.saveSCP()
+// validateReviewFormat checks the review report format
+// when a review report was asked for
+func (s *SCPRun) validateReviewFormat() error {
+	if s.reviewLocation != "" && s.reviewFormat != reviewMarkdown && s.reviewFormat != reviewHTML {
+		return ErrInvalidReviewFormat
+	}
+	return nil
+}
 
+// validateFormat checks the output format
+func (s *SCPRun) validateFormat() error {
+	switch s.format {
+	case formatJSON, formatYAML, formatTerraform, formatCloudFormation, formatCloudFormationJSON:
+	default:
+		return ErrInvalidFormat
+	}
+	if s.format == formatTerraform && s.content != contentJSONEncode && s.content != contentHeredoc {
+		return ErrInvalidTerraformContent
+	}
+	return nil
+}
+
+// saveReview writes the review report when one was asked for
+func (s *SCPRun) saveReview() error {
+	if s.reviewLocation == "" {
+		return nil
+	}
+
+	data, err := renderReview(newReview(s.usage.sources, s.decisions, s.documents), s.reviewFormat)
 	if err != nil {
 		return err
 	}
+	filename := defaultReviewMarkdown
+	if s.reviewFormat == reviewHTML {
+		filename = defaultReviewHTML
+	}
+	return writeNamedOutput(data, s.reviewLocation, filename, s.force)
+}
+
+func main() {
+	os.Exit(execute(os.Args[1:]))
+}
+
+//run is an abstraction function that allows
+//us to test codebase.
+func run(c *SCPConfig) error {
+	scpRun := newSCPRun(c)
+	return scpRun.runStages(scpRun.stages())
+}
+
+// newSCPRun returns a pipeline run for the config
+func newSCPRun(c *SCPConfig) *SCPRun {
+	return &SCPRun{scannerFilename: *c.scannerFilename(), serviceType: *c.serviceType(),
+		thresholdLimit: *c.thresholdLimit(), strategy: *c.selectionStrategy(),
+		thresholdsFile: *c.thresholdsFilename(), baselineFile: *c.baselineFilename(),
+		neverFile: *c.neverFilename(), mergeMode: *c.mergeMode(),
+		outputLocation: *c.outputLocation(), force: *c.forceOverwrite(), sortOrder: *c.sortOrder(),
+		oversize: *c.oversizeMode(), compact: *c.compactWildcards(), catalogFilename: *c.catalogFilename(),
+		sourcesFilename: *c.sourcesFilename(), unknownSource: *c.unknownSourceMode(),
+		recursive: *c.recursiveSearch(), reviewLocation: *c.reviewLocation(), reviewFormat: *c.reviewFormat(),
+		format: *c.outputFormat(), content: *c.terraformContent(), details: c.policyDetails()}
+}
+
+// runStages runs the stages in order, stopping at
+// the first that fails
+func (s *SCPRun) runStages(stages []stage) error {
+	for _, st := range stages {
+		if err := st.run(); err != nil {
+			return newStageError(st, err)
+		}
+	}
 	return nil
 }
 
+// stage is a named step of the scp pipeline along with
+// the exit code used when it fails
+type stage struct {
+	name     string
+	exitCode int
+	run      func() error
+}
+
+// stages returns the pipeline steps in the order they run
+func (s *SCPRun) stages() []stage {
+	return []stage{
+		{name: "validate", exitCode: exitUsage, run: func() error {
+			if _, err := s.validateService(); err != nil {
+				return err
+			}
+			if err := s.validateReviewFormat(); err != nil {
+				return err
+			}
+			return s.validateFormat()
+		}},
+		{name: "load", exitCode: exitInput, run: s.getUsageData},
+		{name: "parse", exitCode: exitInput, run: s.getReport},
+		{name: "catalog", exitCode: exitInput, run: s.getCatalog},
+		{name: "event sources", exitCode: exitInput, run: s.getEventSources},
+		{name: "thresholds", exitCode: exitInput, run: s.getThresholds},
+		{name: "baselines", exitCode: exitInput, run: s.getBaselines},
+		{name: "permissions", exitCode: exitInput, run: s.createPermissions},
+		{name: "generate", exitCode: exitUsage, run: s.createSCP},
+		{name: "size", exitCode: exitPolicy, run: func() error {
+			if err := s.fitSCP(); err != nil {
+				return err
+			}
+			s.decisions = matchPolicy(s.decisions, s.documents)
+			return nil
+		}},
+		{name: "save", exitCode: exitOutput, run: s.saveSCP},
+		{name: "review", exitCode: exitOutput, run: s.saveReview},
+	}
+}
+
+// policyStages returns the pipeline steps that generate
+// the SCP, leaving out those that write files
+func (s *SCPRun) policyStages() []stage {
+	var stages []stage
+	for _, st := range s.stages() {
+		if st.name != "save" && st.name != "review" {
+			stages = append(stages, st)
+		}
+	}
+	return stages
+}
+
+// StageError records the pipeline stage an error
+// happened in and the exit code it maps to
+type StageError struct {
+	Stage string
+	Code  int
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// usageErrors are caused by invalid parameters whichever
+// stage they are found in
+var usageErrors = []error{ErrInvalidSCPType, ErrInvalidThreshold, ErrInvalidStrategy, ErrInvalidMergeMode,
+	ErrInvalidSortOrder, ErrInvalidOversizeMode, ErrInvalidUnknownSourceMode, ErrInvalidReviewFormat,
+	ErrInvalidFormat, ErrInvalidTerraformContent, ErrUnknownField}
+
+// newStageError wraps an error from a stage, classing
+// it as a usage error when caused by invalid parameters
+func newStageError(st stage, err error) *StageError {
+	code := st.exitCode
+	for _, usageErr := range usageErrors {
+		if errors.Is(err, usageErr) {
+			code = exitUsage
+		}
+	}
+	return &StageError{Stage: st.name, Code: code, Err: err}
+}
+
+// exitCode returns the process exit code for an error
+func exitCode(err error) int {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Code
+	}
+	return exitFail
+}
+
 //SCPConfig is a struct that will hold the
 //flag values
 type SCPConfig struct {
 	SCPType     string
 	ScannerFile string
 	Threshold   int64
+	Strategy    string
+	Thresholds  string
+	Baseline    string
+	Never       string
+	Merge       string
+	Output      string
+	Force       bool
+	Sort        string
+	Oversize    string
+	Compact     bool
+	CatalogFile string
+	SourcesFile string
+	Unknown     string
+	Recursive   bool
+	Review      string
+	ReviewFmt   string
+	Format      string
+	Content     string
+	Name        string
+	Description string
+	Targets     string
+	ConfigFile  string
+	origins     map[string]string
 }
 
 //Setup defines script parameters
-func (s *SCPConfig) setup() {
-	flag.StringVar(&s.SCPType, "type", "Allow", "can be either Allow or Deny")
-	flag.StringVar(&s.ScannerFile, "fileloc", "./s3_usage.json", "file location of scanner usage report")
-	flag.Int64Var(&s.Threshold, "threshold", 10, "decision threshold")
+func (s *SCPConfig) setup(fs *flag.FlagSet) {
+	fs.StringVar(&s.ConfigFile, configFlag, "", "yaml or json file of parameters keyed by flag name")
+	fs.StringVar(&s.SCPType, "type", "Allow", "can be either Allow or Deny")
+	fs.StringVar(&s.ScannerFile, "fileloc", "./s3_usage.json", "scanner usage report file, directory or glob pattern")
+	fs.BoolVar(&s.Recursive, "recursive", false, "search sub directories of a -fileloc directory")
+	fs.Int64Var(&s.Threshold, "threshold", 10, "decision threshold")
+	fs.StringVar(&s.Strategy, "strategy", strategyCount, "how the threshold selects api calls, either count, percent, top, percentile or any")
+	fs.StringVar(&s.Thresholds, "thresholds", "", "yaml or json file of per service and per action thresholds and strategies")
+	fs.StringVar(&s.Baseline, "baseline", "", "yaml or json list of actions always in an Allow SCP and never in a Deny SCP")
+	fs.StringVar(&s.Never, "never", "", "yaml or json list of actions never in an Allow SCP and always in a Deny SCP")
+	fs.StringVar(&s.Merge, "merge", mergeSum, "how usage is combined across reports, either sum, account or principal")
+	fs.StringVar(&s.Output, "out", defaultSCPFilename, "output file, directory or - for stdout, named after -format when not given")
+	fs.StringVar(&s.Format, "format", formatJSON, "output format, either json, yaml, terraform, cloudformation or cloudformation-json")
+	fs.StringVar(&s.Content, "terraform-content", contentJSONEncode, "how terraform output holds the policy, either jsonencode or heredoc")
+	fs.StringVar(&s.Name, "name", "scanner-usage", "policy name used by deployment formats")
+	fs.StringVar(&s.Description, "description", "Generated from scanner usage reports", "policy description used by deployment formats")
+	fs.StringVar(&s.Targets, "targets", "", "comma separated organizational unit, account or root ids to attach the policy to")
+	fs.BoolVar(&s.Force, "force", false, "overwrite an existing output file")
+	fs.StringVar(&s.Review, "review", "", "review report file, directory or - for stdout")
+	fs.StringVar(&s.ReviewFmt, "review-format", reviewMarkdown, "review report format, either markdown or html")
+	fs.StringVar(&s.Sort, "sort", sortByName, "action order, either name or count")
+	fs.StringVar(&s.Oversize, "oversize", oversizeError, "handling of SCPs over the size limit, either error, compact or split")
+	fs.BoolVar(&s.Compact, "compact", false, "collapse actions into wildcards where the action catalog shows it is safe")
+	fs.StringVar(&s.CatalogFile, "catalog", "", "action catalog file to use instead of the bundled one")
+	fs.StringVar(&s.SourcesFile, "sources", "", "event source to iam prefix mapping file added to the bundled one")
+	fs.StringVar(&s.Unknown, "unknown-source", unknownSourceWarn, "handling of unmapped event sources, either warn or error")
 }
 
 //ServiceType returns the SCP Type parameter
@@ -188,6 +624,102 @@ func (s *SCPConfig) thresholdLimit() *int64 {
 	return &s.Threshold
 }
 
+// selectionStrategy returns the api call selection strategy
+func (s *SCPConfig) selectionStrategy() *string {
+	return &s.Strategy
+}
+
+// thresholdsFilename returns the per service thresholds file
+func (s *SCPConfig) thresholdsFilename() *string {
+	return &s.Thresholds
+}
+
+// baselineFilename returns the always allowed actions file
+func (s *SCPConfig) baselineFilename() *string {
+	return &s.Baseline
+}
+
+// neverFilename returns the never allowed actions file
+func (s *SCPConfig) neverFilename() *string {
+	return &s.Never
+}
+
+// mergeMode returns the report merge mode
+func (s *SCPConfig) mergeMode() *string {
+	return &s.Merge
+}
+
+// outputLocation returns the scp output destination
+func (s *SCPConfig) outputLocation() *string {
+	return &s.Output
+}
+
+// forceOverwrite returns whether existing output is overwritten
+func (s *SCPConfig) forceOverwrite() *bool {
+	return &s.Force
+}
+
+// sortOrder returns the action sort order
+func (s *SCPConfig) sortOrder() *string {
+	return &s.Sort
+}
+
+// oversizeMode returns how oversized SCPs are handled
+func (s *SCPConfig) oversizeMode() *string {
+	return &s.Oversize
+}
+
+// compactWildcards returns whether actions are collapsed into wildcards
+func (s *SCPConfig) compactWildcards() *bool {
+	return &s.Compact
+}
+
+// catalogFilename returns the action catalog file
+func (s *SCPConfig) catalogFilename() *string {
+	return &s.CatalogFile
+}
+
+// sourcesFilename returns the event source mapping file
+func (s *SCPConfig) sourcesFilename() *string {
+	return &s.SourcesFile
+}
+
+// unknownSourceMode returns how unmapped event sources are handled
+func (s *SCPConfig) unknownSourceMode() *string {
+	return &s.Unknown
+}
+
+// recursiveSearch returns whether scanner directories are searched recursively
+func (s *SCPConfig) recursiveSearch() *bool {
+	return &s.Recursive
+}
+
+// reviewLocation returns the review report destination
+func (s *SCPConfig) reviewLocation() *string {
+	return &s.Review
+}
+
+// reviewFormat returns the review report format
+func (s *SCPConfig) reviewFormat() *string {
+	return &s.ReviewFmt
+}
+
+// outputFormat returns the scp output format
+func (s *SCPConfig) outputFormat() *string {
+	return &s.Format
+}
+
+// terraformContent returns how terraform output holds the policy
+func (s *SCPConfig) terraformContent() *string {
+	return &s.Content
+}
+
+// policyDetails returns the name, description and targets
+// of the policy used by deployment formats
+func (s *SCPConfig) policyDetails() policyDetails {
+	return policyDetails{Name: s.Name, Description: s.Description, Targets: parseTargets(s.Targets)}
+}
+
 //Report represents a structure for a scp
 type Report struct {
 	Account struct {
@@ -205,78 +737,312 @@ type Report struct {
 			EventName string `json:"event_name"`
 			Count     int64  `json:"count"`
 		} `json:"service_usage"`
+		RoleUsage []struct {
+			EventSource string `json:"event_source"`
+			EventName   string `json:"event_name"`
+			Count       int64  `json:"count"`
+		} `json:"role_usage"`
 	} `json:"results"`
+	Usage     []Usage `json:"-"`
+	Principal string  `json:"-"`
+}
+
+// Usage is the common model both scanner report
+// shapes are decoded into. Once translated EventName is
+// an iam action and EventNames the event names of the
+// calls that need it.
+type Usage struct {
+	EventSource string
+	EventName   string
+	Count       int64
+	EventNames  []string
 }
 
-//SCP is a struct representing a AWS SCP document
-type SCP struct {
-	Version   string `json:"Version"`
-	Statement struct {
-		Effect string `json:"Effect"`
-		Action []string
-	} `json:"Statement"`
-	Resource string `json:"Resource"`
+// normalise flattens the service_usage or role_usage
+// results of a report into its Usage list
+func (r *Report) normalise() error {
+	if r.Results.ServiceUsage == nil && r.Results.RoleUsage == nil {
+		return ErrUnknownReportFormat
+	}
+
+	r.Usage = []Usage{}
+	for _, v := range r.Results.ServiceUsage {
+		r.Usage = append(r.Usage, Usage{EventSource: r.Results.Service, EventName: v.EventName, Count: v.Count})
+	}
+	for _, v := range r.Results.RoleUsage {
+		r.Usage = append(r.Usage, Usage{EventSource: v.EventSource, EventName: v.EventName, Count: v.Count})
+	}
+	return nil
+}
+
+// permissions maps an aws service prefix to the api
+// calls selected for it and their usage count
+type permissions map[string]map[string]int64
+
+// add records an api call against its service
+func (p permissions) add(service string, action string, count int64) {
+	if _, ok := p[service]; !ok {
+		p[service] = map[string]int64{}
+	}
+	p[service][action] += count
+}
+
+// count returns the number of api calls across all services
+func (p permissions) count() int {
+	total := 0
+	for _, actions := range p {
+		total += len(actions)
+	}
+	return total
 }
 
 var ErrInvalidParameters = errors.New("input parameters missing")
 var ErrInvalidThreshold = errors.New("threshold limit must be greater than zero")
 var ErrInvalidSCPType = errors.New("scp type must be Allow or Deny")
-
-// ServiceName returns a formatted service name
-// from event_source data
-func serviceName(eventSource string) string {
-	s := strings.Split(eventSource, ".")
-	return s[0]
-}
+var ErrOutputExists = errors.New("output file already exists, use -force to overwrite")
+var ErrInvalidSortOrder = errors.New("sort order must be name or count")
+var ErrInvalidOversizeMode = errors.New("oversize mode must be error, compact or split")
+var ErrSplitToStdout = errors.New("a split SCP can not be written to stdout")
+var ErrInvalidMergeMode = errors.New("merge mode must be sum, account or principal")
+var ErrUnknownReportFormat = errors.New("report has neither service_usage nor role_usage results")
 
 //LoadScannerFile loads the scanner json report
-func loadScannerFile(scannerFileName string) ([]byte, error) {
-	scannerData, err := loadFile(scannerFileName)
+func loadScannerFile(scannerFileName string) (io.ReadCloser, error) {
+	if scannerFileName == stdinSource {
+		return ioutil.NopCloser(stdin), nil
+	}
+	scannerData, err := openFile(scannerFileName)
 	if err != nil {
 		return nil, ErrInvalidParameters
 	}
 	return scannerData, nil
 }
 
-// directoryCheck checks a directory for files to
-// process
+// directoryCheck reports whether a scanner file
+// location is a directory of files to process
 func directoryCheck(directory string) (bool, error) {
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
+	info, err := os.Stat(directory)
+	if err != nil {
 		return false, err
 	}
 
-	return true, nil
+	return info.IsDir(), nil
 }
 
-//GenerateReport will marshall the incoming json data
-//from the scanner program into a struct.
-func generateReport(jsonData []byte) (*[]Report, error) {
-	var v []Report
-	err := json.Unmarshal(jsonData, &v)
-
+// decodeReports streams the array of reports in a scanner
+// file, handing each to fn once normalised. Only a single
+// report is held in memory at a time, however large the file.
+func decodeReports(r io.Reader, fn func(Report)) error {
+	dec := json.NewDecoder(r)
+	token, err := dec.Token()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("%w: expected an array of reports", ErrUnknownReportFormat)
+	}
+
+	for dec.More() {
+		var report Report
+		if err := dec.Decode(&report); err != nil {
+			return err
+		}
+		if err := report.normalise(); err != nil {
+			return err
+		}
+		fn(report)
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+// Report merge modes
+const (
+	mergeSum       = "sum"
+	mergeAccount   = "account"
+	mergePrincipal = "principal"
+)
+
+// apiCall identifies a single api call of an event source
+type apiCall struct {
+	eventSource string
+	eventName   string
+}
+
+// usageAggregator sums usage per account and per principal
+// report by report, so reports need not be kept once they
+// have been added
+type usageAggregator struct {
+	calls      []apiCall
+	seen       map[apiCall]bool
+	accounts   map[string]map[apiCall]int64
+	principals map[string]map[apiCall]int64
+	sources    []reportSource
+	sourceKeys map[sourceKey]int
+}
+
+// reportSource describes the reports of an account, or
+// of a principal of an account, for a single period whose
+// usage has been aggregated
+type reportSource struct {
+	AccountID   string
+	AccountName string
+	Principal   string
+	Description string
+	Year        string
+	Month       string
+	Reports     int
+	Calls       int64
+}
+
+// sourceKey identifies the reports a reportSource
+// accumulates
+type sourceKey struct {
+	account   string
+	principal string
+	year      string
+	month     string
+}
+
+func newUsageAggregator() *usageAggregator {
+	return &usageAggregator{seen: map[apiCall]bool{}, accounts: map[string]map[apiCall]int64{}, principals: map[string]map[apiCall]int64{},
+		sourceKeys: map[sourceKey]int{}}
+}
+
+// add sums the usage of a report into its account and
+// the principal that made the calls. Scanner reports have
+// no principal, so the whole account is one principal.
+func (a *usageAggregator) add(r Report) {
+	source := reportSource{AccountID: r.Account.Identifier, AccountName: r.Account.AccountName, Principal: r.Principal,
+		Description: r.Description, Year: r.Partition.Year, Month: r.Partition.Month, Reports: 1}
+	principal := r.Account.Identifier + " " + r.Principal
+	for _, u := range r.Usage {
+		c := apiCall{eventSource: u.EventSource, eventName: u.EventName}
+		a.see(c)
+		addCall(a.accounts, r.Account.Identifier, c, u.Count)
+		addCall(a.principals, principal, c, u.Count)
+		source.Calls += u.Count
+	}
+	a.addSource(source)
+}
+
+// addSource counts a report against the source of its
+// account, principal and period, so a source is listed
+// once however many files its reports are spread across
+func (a *usageAggregator) addSource(source reportSource) {
+	key := sourceKey{account: source.AccountID, principal: source.Principal, year: source.Year, month: source.Month}
+	if i, ok := a.sourceKeys[key]; ok {
+		a.sources[i].Reports += source.Reports
+		a.sources[i].Calls += source.Calls
+		return
+	}
+	a.sourceKeys[key] = len(a.sources)
+	a.sources = append(a.sources, source)
+}
+
+// combine adds the usage collected by another aggregator
+func (a *usageAggregator) combine(other *usageAggregator) {
+	for _, source := range other.sources {
+		a.addSource(source)
+	}
+	for _, c := range other.calls {
+		a.see(c)
+	}
+	for id, usage := range other.accounts {
+		for c, count := range usage {
+			addCall(a.accounts, id, c, count)
+		}
+	}
+	for principal, usage := range other.principals {
+		for c, count := range usage {
+			addCall(a.principals, principal, c, count)
+		}
+	}
+}
+
+// see records the order calls are first seen in
+func (a *usageAggregator) see(c apiCall) {
+	if !a.seen[c] {
+		a.seen[c] = true
+		a.calls = append(a.calls, c)
+	}
+}
+
+// addCall sums the count of a call into the usage of
+// an account or principal
+func addCall(usage map[string]map[apiCall]int64, key string, c apiCall, count int64) {
+	if _, ok := usage[key]; !ok {
+		usage[key] = map[apiCall]int64{}
+	}
+	usage[key][c] += count
+}
+
+// merge combines the usage of every account or principal
+// as set by the merge mode, keeping the calls in the order
+// first seen
+func (a *usageAggregator) merge(mode string) (*Report, error) {
+	if mode != mergeSum && mode != mergeAccount && mode != mergePrincipal {
+		return nil, ErrInvalidMergeMode
 	}
 
-	return &v, nil
+	groups := a.accounts
+	if mode == mergePrincipal {
+		groups = a.principals
+	}
+	totals := map[apiCall]int64{}
+	for _, usage := range groups {
+		for c, count := range usage {
+			if mode == mergeSum {
+				totals[c] += count
+			} else if count > totals[c] {
+				totals[c] = count
+			}
+		}
+	}
 
+	merged := &Report{Usage: []Usage{}}
+	for _, c := range a.calls {
+		if _, ok := totals[c]; !ok {
+			continue
+		}
+		merged.Usage = append(merged.Usage, Usage{EventSource: c.eventSource, EventName: c.eventName, Count: totals[c]})
+	}
+	return merged, nil
 }
 
-//generateList a list of all the api calls
-//That are above and equal to the threshold
-func generateList(threshold int64, reportData *Report, apiEval func(int64, int64) bool) (map[string]int64, error) {
+// generateList a list of all the api calls
+// selected by the most specific strategy for each,
+// grouped by the service they belong to. Each call
+// is judged against the usage of its own service.
+// Calls from unknown event sources are left out.
+func generateList(strategies strategySet, reportData *Report, sources eventSourceMap) permissions {
+	services := serviceUsages(reportData, sources)
 
-	if threshold <= 0 {
-		return nil, ErrInvalidThreshold
+	allowList := permissions{}
+	for _, v := range reportData.Usage {
+		service, ok := sources.serviceName(v.EventSource)
+		if ok && strategies.strategyFor(service, v.EventName).selects(v.Count, services[service]) {
+			allowList.add(service, v.EventName, v.Count)
+		}
 	}
+	return allowList
+}
 
-	allowList := map[string]int64{}
-	for _, v := range reportData.Results.ServiceUsage {
-		if apiEval(v.Count, threshold) {
-			allowList[v.EventName] = v.Count
+// serviceUsages returns the usage of each service
+// the api calls of the report belong to
+func serviceUsages(reportData *Report, sources eventSourceMap) map[string]serviceUsage {
+	serviceCounts := map[string][]int64{}
+	for _, v := range reportData.Usage {
+		if service, ok := sources.serviceName(v.EventSource); ok {
+			serviceCounts[service] = append(serviceCounts[service], v.Count)
 		}
 	}
-	return allowList, nil
+	services := map[string]serviceUsage{}
+	for service, counts := range serviceCounts {
+		services[service] = newServiceUsage(counts)
+	}
+	return services
 }
 
 //greaterThan evaluates the value
@@ -288,33 +1054,191 @@ func greaterThan(value int64, threshold int64) bool {
 	return isGreaterThan
 }
 
-//lessThan evaluates the value
-func lessThan(value int64, threshold int64) bool {
-	isLessThan := false
-	if value < threshold {
-		isLessThan = true
+// Action sort orders
+const (
+	sortByName  = "name"
+	sortByCount = "count"
+)
+
+// generateSCP generates an SCP with a single statement,
+// translating event names into iam actions using the
+// catalog and prefixing each with the service it belongs
+// to. Actions are de-duplicated and sorted so identical
+// input always produces an identical policy.
+func generateSCP(scpType string, permissionData permissions, order string, catalog actionCatalog) (scp SCP) {
+	effect := scpEffect(scpType)
+	statement := Statement{Sid: effect + "ScannerUsage", Effect: effect}
+	translated, _ := catalog.translate(permissionData)
+	statement.Action = sortActions(dedupeActions(translated), order)
+	statement.Resource = StringList{"*"}
+
+	scp = SCP{Version: policyVersion, Statement: Statements{statement}}
+	return scp
+}
+
+// Output destinations
+const (
+	stdoutDestination = "-"
+	stdinSource       = "-"
+)
+
+// saveSCP saves the scp file to the destination as
+// JSON or YAML
+func saveSCP(scp SCP, destination string, format string, force bool) error {
+	data, err := marshalSCP(scp, format)
+	if err != nil {
+		return err
 	}
-	return isLessThan
+	return writeNamedOutput(data, destination, scpFilename(format), force)
+}
+
+// splitManifest records which actions ended up
+// in which document of a split SCP
+type splitManifest struct {
+	Documents []manifestEntry `json:"documents"`
+}
+
+type manifestEntry struct {
+	File    string   `json:"file"`
+	Size    int      `json:"size"`
+	Actions []string `json:"actions"`
 }
 
-//generateSCP generates an SCP
-func generateSCP(scpType string, awsService string, permissionData map[string]int64) (scp SCP) {
-	scp = SCP{}
-	scp.Version = "2012-10-17"
-	for k := range permissionData {
-		p := awsService + ":" + k
-		scp.Statement.Action = append(scp.Statement.Action, p)
-		scp.Statement.Effect = scpType
+// saveSplitSCP saves each document to a numbered file
+// next to the destination along with a manifest
+func saveSplitSCP(documents []SCP, destination string, format string, force bool) error {
+	if destination == stdoutDestination {
+		return ErrSplitToStdout
 	}
-	scp.Resource = "*"
-	return scp
+
+	filename := destination
+	if info, err := os.Stat(destination); err == nil && info.IsDir() {
+		filename = filepath.Join(destination, scpFilename(format))
+	}
+
+	manifest := splitManifest{}
+	for i, scp := range documents {
+		documentName := numberedFilename(filename, strconv.Itoa(i+1))
+		if err := saveSCP(scp, documentName, format, force); err != nil {
+			return err
+		}
+
+		var actions []string
+		for _, statement := range scp.Statement {
+			actions = append(actions, statement.Action...)
+		}
+		manifest.Documents = append(manifest.Documents, manifestEntry{File: documentName, Size: scpSize(scp), Actions: actions})
+		fmt.Fprintf(stderr, "%s: %d actions, %d characters\n", documentName, len(actions), scpSize(scp))
+	}
+
+	if len(documents) > maxSCPsPerTarget {
+		fmt.Fprintf(stderr, "warning: %d documents exceed the %d SCPs that can be attached to a target\n", len(documents), maxSCPsPerTarget)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+	manifestName := numberedFilename(filename, "manifest")
+	if format == formatYAML {
+		manifestName = strings.TrimSuffix(manifestName, filepath.Ext(manifestName)) + ".json"
+	}
+	return writeOutput(manifestData, manifestName, force)
 }
 
-//saveSCP saves the scp file
-func saveSCP(scp SCP) error {
-	jsonData, _ := json.MarshalIndent(scp, "", " ")
-	err := ioutil.WriteFile("testSCP.json", jsonData, 0644)
-	return err
+// numberedFilename inserts a suffix before the
+// file extension, scp.json becomes scp-1.json
+func numberedFilename(filename string, suffix string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + suffix + ext
+}
+
+// writeOutput writes data to stdout when the destination
+// is -, into the default file when it is a directory and
+// to the named file otherwise. Existing files are only
+// replaced when force is set.
+func writeOutput(data []byte, destination string, force bool) error {
+	return writeNamedOutput(data, destination, defaultSCPFilename, force)
+}
+
+// writeNamedOutput writes data as writeOutput does, using
+// the given filename when the destination is a directory
+func writeNamedOutput(data []byte, destination string, defaultFilename string, force bool) error {
+	if destination == stdoutDestination {
+		_, err := stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	filename := destination
+	if info, err := os.Stat(destination); err == nil && info.IsDir() {
+		filename = filepath.Join(destination, defaultFilename)
+	}
+
+	if _, err := os.Stat(filename); err == nil && !force {
+		return ErrOutputExists
+	}
+	return writeFile(filename, data, 0644)
+}
+
+// dedupeActions returns the usage count of each action.
+// Actions are case insensitive, so differently cased
+// spellings are counted together under the first of them
+// in sort order.
+func dedupeActions(permissionData permissions) map[string]int64 {
+	spelling := map[string]string{}
+	counts := map[string]int64{}
+	for awsService, actions := range permissionData {
+		for k, count := range actions {
+			p := awsService + ":" + k
+			key := strings.ToLower(p)
+			if s, ok := spelling[key]; !ok || p < s {
+				spelling[key] = p
+			}
+			counts[key] += count
+		}
+	}
+
+	deduped := make(map[string]int64, len(counts))
+	for key, count := range counts {
+		deduped[spelling[key]] = count
+	}
+	return deduped
+}
+
+// sortActions returns the actions ordered alphabetically,
+// or by descending usage count with ties broken by name
+func sortActions(counts map[string]int64, order string) []string {
+	actions := make([]string, 0, len(counts))
+	for action := range counts {
+		actions = append(actions, action)
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		a, b := actions[i], actions[j]
+		if order == sortByCount && counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		return a < b
+	})
+	return actions
+}
+
+// checkSortParameter checks that the sort order
+// is one we support
+func checkSortParameter(order string) bool {
+	return order == sortByName || order == sortByCount
+}
+
+// scpEffect returns the policy Effect for an scp
+// type regardless of the case it was entered in
+func scpEffect(scpType string) string {
+	switch strings.ToLower(scpType) {
+	case "allow":
+		return "Allow"
+	case "deny":
+		return "Deny"
+	}
+	return scpType
 }
 
 //checkSCPParameter checks that SCP parameter was
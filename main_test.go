@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
+var update = flag.Bool("update", false, "update golden files")
+
 func TestMain(m *testing.M) {
+	stderr = ioutil.Discard
 	rc := m.Run()
 	if rc == 0 && testing.CoverMode() != "" {
 		c := testing.Coverage()
@@ -22,24 +34,49 @@ func TestMain(m *testing.M) {
 //TestGenerateServiceName tests a service name can be
 //created from the incoming scanner event_source
 func TestGenerateServiceName(t *testing.T) {
-	eventSource := "s3.amazonaws.com"
-	serviceName := serviceName(eventSource)
-	assert.Equal(t, "s3", serviceName)
+	cases := []struct {
+		eventSource string
+		expected    string
+		known       bool
+	}{
+		{eventSource: "s3.amazonaws.com", expected: "s3", known: true},
+		{eventSource: "monitoring.amazonaws.com", expected: "cloudwatch", known: true},
+		{eventSource: "email.amazonaws.com", expected: "ses", known: true},
+		{eventSource: "Application-Insights.amazonaws.com", expected: "applicationinsights", known: true},
+		{eventSource: "s3.amazon.com", expected: "", known: false},
+	}
+
+	for _, c := range cases {
+		serviceName, known := defaultEventSources.serviceName(c.eventSource)
+		assert.Equal(t, c.expected, serviceName)
+		assert.Equal(t, c.known, known)
+	}
 }
 
 //TestLoadScannerReport tests that a scanner report can
 //be loaded
 func TestLoadScannerValidReport(t *testing.T) {
 	scannerFileName := "./testdata/s3_scanner_report.json"
-    loadFileMock := func(filename string)([]byte, error){
-		return []byte("It Worked"), nil
-	}
-	scannerFileData, _ := loadScannerFile(scannerFileName)
+	scannerFile, _ := loadScannerFile(scannerFileName)
+	defer scannerFile.Close()
 
-	loadFile = loadFileMock
+	scannerFileData, _ := ioutil.ReadAll(scannerFile)
 	assert.True(t, len(scannerFileData) > 0)
 }
 
+// TestLoadScannerStdin tests that - reads the scanner
+// report from stdin
+func TestLoadScannerStdin(t *testing.T) {
+	stdin = strings.NewReader(getScannerMessage())
+	defer func() { stdin = os.Stdin }()
+
+	scannerFile, err := loadScannerFile(stdinSource)
+	scannerFileData, _ := ioutil.ReadAll(scannerFile)
+
+	assert.Nil(t, err)
+	assert.Equal(t, getScannerMessage(), string(scannerFileData))
+}
+
 //TestLoadScannerInValidReport tests that a scanner report can
 //be loaded
 func TestLoadScannerInValidReport(t *testing.T) {
@@ -47,7 +84,7 @@ func TestLoadScannerInValidReport(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return nil, ErrInvalidParameters
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	_, err := loadScannerFile(scannerFileName)
 
 	assert.NotNil(t, err)
@@ -79,11 +116,37 @@ func TestDecodeFile(t *testing.T) {
 	jsonData := getScannerMessage()
 	testStub := jsonFileStub{inputData: jsonData}
 	testData := testStub.getData()
-	reports, _ := generateReport(testData)
+	reports, _ := decodeTestReports(testData)
 	report := *reports
 
 	assert.NotNil(t, report)
 	assert.Equal(t, 10, len(report[0].Results.ServiceUsage))
+	assert.Equal(t, 10, len(report[0].Usage))
+	assert.Equal(t, "s3.amazonaws.com", report[0].Usage[0].EventSource)
+}
+
+// TestDecodeRoleUsageFile decodes a role_usage report where
+// each entry carries its own event source
+func TestDecodeRoleUsageFile(t *testing.T) {
+	testData, err := ioutil.ReadFile("./testdata/s3_usage.json")
+	if err != nil {
+		t.Fatalf("could not read role usage test data")
+	}
+	reports, err := decodeTestReports(testData)
+	report := *reports
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(report[0].Results.RoleUsage), len(report[0].Usage))
+	assert.Equal(t, "application-insights.amazonaws.com", report[0].Usage[0].EventSource)
+	assert.Equal(t, "ListApplications", report[0].Usage[0].EventName)
+}
+
+// TestDecodeUnknownReportFormat returns an error when
+// neither results shape is present
+func TestDecodeUnknownReportFormat(t *testing.T) {
+	testData := []byte(`[{"account": {"identifier": "999888777666"}, "results": {}}]`)
+	_, err := decodeTestReports(testData)
+	assert.Equal(t, ErrUnknownReportFormat, err)
 }
 
 //TestDecodeFileError returns an error
@@ -91,17 +154,80 @@ func TestDecodeFileError(t *testing.T) {
 	jsonData := getCorruptedScannerMessage()
 	testStub := jsonFileStub{inputData: jsonData}
 	testData := testStub.getData()
-	_, err := generateReport(testData)
+	_, err := decodeTestReports(testData)
 	assert.Error(t, err)
 }
 
+// TestDecodeReportsStreams tests that each report is
+// handed over as soon as it has been read, before the
+// rest of the stream is available
+func TestDecodeReportsStreams(t *testing.T) {
+	first := `[{"account": {"identifier": "111111111111"}, "results": {"role_usage": []}},`
+	stream := io.MultiReader(strings.NewReader(first), iotest.ErrReader(io.ErrUnexpectedEOF))
+
+	var accounts []string
+	err := decodeReports(stream, func(r Report) {
+		accounts = append(accounts, r.Account.Identifier)
+	})
+
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, []string{"111111111111"}, accounts)
+}
+
+// TestDecodeReportsNotArray tests that a scanner file
+// must hold an array of reports
+func TestDecodeReportsNotArray(t *testing.T) {
+	err := decodeReports(strings.NewReader(`{"Version": "2012-10-17"}`), func(Report) {})
+	assert.True(t, errors.Is(err, ErrUnknownReportFormat))
+}
+
+// TestUsageAggregatorCombine tests that combining usage
+// matches adding every report to a single aggregator
+func TestUsageAggregatorCombine(t *testing.T) {
+	reports := getMultiAccountReports()
+	combined := newUsageAggregator()
+	for _, r := range reports {
+		combined.combine(aggregateReports([]Report{r}))
+	}
+
+	for _, mode := range []string{mergeSum, mergeAccount} {
+		expected, _ := aggregateReports(reports).merge(mode)
+		actual, err := combined.merge(mode)
+
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+// TestUsageAggregatorSources tests that the reports of a
+// principal are listed once however many files hold them
+func TestUsageAggregatorSources(t *testing.T) {
+	report := func(account string, principal string, count int64) Report {
+		r := Report{Description: "CloudTrail events of " + principal, Principal: principal,
+			Usage: []Usage{{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: count}}}
+		r.Account.Identifier = account
+		return r
+	}
+	usage := newUsageAggregator()
+	for i := 0; i < 3; i++ {
+		file := aggregateReports([]Report{report("111111111111", "role/a", 2), report("111111111111", "role/b", 1)})
+		usage.combine(file)
+	}
+	usage.add(report("222222222222", "role/a", 5))
+
+	assert.Equal(t, []reportSource{
+		{AccountID: "111111111111", Principal: "role/a", Description: "CloudTrail events of role/a", Reports: 3, Calls: 6},
+		{AccountID: "111111111111", Principal: "role/b", Description: "CloudTrail events of role/b", Reports: 3, Calls: 3},
+		{AccountID: "222222222222", Principal: "role/a", Description: "CloudTrail events of role/a", Reports: 1, Calls: 5},
+	}, usage.sources)
+}
+
 //TestGenerateAllowListData tests that
 //API actions above a threshold are mapped to
 //A new data structure
 func TestGenerateAllowListData(t *testing.T) {
 	testData := getTestReport()
 	r := *testData
-	apiFn := greaterThan
 
 	cases := []struct {
 		threshold int64
@@ -126,9 +252,9 @@ func TestGenerateAllowListData(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		allowList, _ := generateList(c.threshold, &c.report, apiFn)
+		allowList := generateList(strategySet{fallback: countStrategy{threshold: c.threshold}}, &c.report, defaultEventSources)
 		assert.NotNil(t, allowList)
-		assert.Equal(t, c.expected, int64(len(allowList)))
+		assert.Equal(t, c.expected, int64(allowList.count()))
 	}
 }
 
@@ -138,7 +264,6 @@ func TestGenerateAllowListData(t *testing.T) {
 func TestGenerateDenyListData(t *testing.T) {
 	testData := getTestReport()
 	r := *testData
-	apiFn := lessThan
 
 	cases := []struct {
 		threshold int64
@@ -163,61 +288,514 @@ func TestGenerateDenyListData(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		denyList, _ := generateList(c.threshold, &c.report, apiFn)
+		denyList := generateList(strategySet{fallback: inverseStrategy{countStrategy{threshold: c.threshold}}}, &c.report, defaultEventSources)
 		assert.NotNil(t, denyList)
-		assert.Equal(t, c.expected, int64(len(denyList)))
+		assert.Equal(t, c.expected, int64(denyList.count()))
 	}
 }
 
-//TestGenerateAllowListGeneratesError tests for
-//An error being returned for zero and negative
-//Thresholds
-func TestGenerateAllowListGeneratesError(t *testing.T) {
-	testReports := getTestReport()
-	testReport := *testReports
-	apiFn := greaterThan
+// TestGenerateListRoleUsage tests that api calls
+// from a role report are grouped per service
+func TestGenerateListRoleUsage(t *testing.T) {
+	testData := getRoleUsageReport()
+	allowList := generateList(strategySet{fallback: countStrategy{threshold: 1}}, &testData, defaultEventSources)
+
+	assert.Equal(t, 3, len(allowList))
+	assert.Equal(t, int64(9), allowList["cloudformation"]["DescribeStackResources"])
+	assert.Equal(t, int64(1), allowList["kms"]["Decrypt"])
+	assert.Equal(t, int64(4), allowList["s3"]["GetBucketAcl"])
+}
+
+// TestMergeReports tests that usage from every report
+// is combined by summing or by busiest account
+func TestMergeReports(t *testing.T) {
+	reports := getMultiAccountReports()
 
 	cases := []struct {
-		threshold int64
-		report    Report
-		expected  error
+		mode     string
+		expected map[string]int64
 	}{
 		{
-			threshold: 0,
-			report:    testReport[0],
-			expected:  ErrInvalidParameters,
+			mode:     mergeSum,
+			expected: map[string]int64{"ListBuckets": 150, "GetObject": 231, "PutObject": 12},
 		},
 		{
-			threshold: -1,
-			report:    testReport[0],
-			expected:  ErrInvalidParameters,
+			mode:     mergeAccount,
+			expected: map[string]int64{"ListBuckets": 145, "GetObject": 231, "PutObject": 8},
 		},
 	}
 
 	for _, c := range cases {
-		_, err := generateList(c.threshold, &c.report, apiFn)
-		assert.Error(t, err)
+		merged, err := aggregateReports(reports).merge(c.mode)
+		assert.Nil(t, err)
+
+		actual := map[string]int64{}
+		for _, u := range merged.Usage {
+			actual[u.EventName] = u.Count
+		}
+		assert.Equal(t, c.expected, actual)
 	}
 }
 
+// TestMergeReportsInvalidMode tests that an unknown
+// merge mode returns an error
+func TestMergeReportsInvalidMode(t *testing.T) {
+	_, err := aggregateReports(getMultiAccountReports()).merge("average")
+	assert.Equal(t, ErrInvalidMergeMode, err)
+}
+
+// TestCreatePermissionsAllReports tests that every report
+// in a scanner file contributes to the permissions, which
+// are keyed by the iam action each call needs
+func TestCreatePermissionsAllReports(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	reports := getMultiAccountReports()
+	testSCPRun.usage = aggregateReports(reports)
+
+	err := testSCPRun.createPermissions()
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(150), testSCPRun.permissionSet["s3"]["ListAllMyBuckets"])
+	assert.Equal(t, int64(12), testSCPRun.permissionSet["s3"]["PutObject"])
+	assert.Equal(t, 3, testSCPRun.permissionSet.count())
+}
+
+// TestCreatePermissionsInvalidMergeMode tests that the
+// merge mode is validated
+func TestCreatePermissionsInvalidMergeMode(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.mergeMode = "average"
+	reports := getMultiAccountReports()
+	testSCPRun.usage = aggregateReports(reports)
+
+	err := testSCPRun.createPermissions()
+	assert.Equal(t, ErrInvalidMergeMode, err)
+}
+
+// TestCreateDenySCPSharedActions tests that a deny SCP
+// never denies an iam action that a call left allowed
+// also needs, when several event names share an action
+func TestCreateDenySCPSharedActions(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.serviceType = "Deny"
+	report := Report{Usage: []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 1000},
+		{EventSource: "s3.amazonaws.com", EventName: "PutObject", Count: 500},
+		{EventSource: "s3.amazonaws.com", EventName: "ListObjectsV2", Count: 900},
+		{EventSource: "s3.amazonaws.com", EventName: "CopyObject", Count: 1},
+		{EventSource: "s3.amazonaws.com", EventName: "ListObjects", Count: 1},
+		{EventSource: "s3.amazonaws.com", EventName: "HeadBucket", Count: 2},
+		{EventSource: "s3.amazonaws.com", EventName: "GetBucketCors", Count: 3},
+	}}
+	testSCPRun.usage = aggregateReports([]Report{report})
+
+	assert.Nil(t, testSCPRun.createPermissions())
+	assert.Nil(t, testSCPRun.createSCP())
+
+	assert.Equal(t, []string{"s3:GetBucketCORS"}, []string(testSCPRun.scp.Statement[0].Action))
+}
+
 //TestGenerateAllowSCP test that we can
 //generate an SCP from an Allow List
 func TestGenerateAllowSCP(t *testing.T) {
 	allowList := getTestAllowListFilteredData()
 	scpType := "Allow"
 	awsService := "s3"
-	generated := generateSCP(scpType, awsService, allowList)
+	generated := generateSCP(scpType, permissions{awsService: allowList}, sortByName, nil)
 
 	assert.Equal(t, "2012-10-17", generated.Version)
+	assert.Equal(t, len(allowList), len(generated.Statement[0].Action))
+	assert.Equal(t, "AllowScannerUsage", generated.Statement[0].Sid)
+	assert.Equal(t, StringList{"*"}, generated.Statement[0].Resource)
+}
+
+// TestGenerateSCPNormalisesEffect tests that a lower
+// case scp type produces a valid Effect
+func TestGenerateSCPNormalisesEffect(t *testing.T) {
+	generated := generateSCP("deny", permissions{"s3": getTestAllowListFilteredData()}, sortByName, nil)
+	assert.Equal(t, "Deny", generated.Statement[0].Effect)
+}
+
+// TestGenerateMultiServiceSCP tests that each action is
+// prefixed with its own service name
+func TestGenerateMultiServiceSCP(t *testing.T) {
+	testData := getRoleUsageReport()
+	allowList := generateList(strategySet{fallback: countStrategy{threshold: 1}}, &testData, defaultEventSources)
+	generated := generateSCP("Allow", allowList, sortByName, nil)
+
+	assert.Equal(t, "Allow", generated.Statement[0].Effect)
+	assert.Equal(t, []string{
+		"cloudformation:DescribeStackResources",
+		"kms:Decrypt",
+		"s3:GetBucketAcl",
+	}, []string(generated.Statement[0].Action))
+}
+
+// TestSortActions tests that actions are ordered by
+// name or by usage count
+func TestSortActions(t *testing.T) {
+	counts := map[string]int64{"s3:PutObject": 4, "ec2:DescribeVpcs": 9, "s3:GetObject": 9, "kms:Decrypt": 1}
+
+	cases := []struct {
+		order    string
+		expected []string
+	}{
+		{
+			order:    sortByName,
+			expected: []string{"ec2:DescribeVpcs", "kms:Decrypt", "s3:GetObject", "s3:PutObject"},
+		},
+		{
+			order:    sortByCount,
+			expected: []string{"ec2:DescribeVpcs", "s3:GetObject", "s3:PutObject", "kms:Decrypt"},
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, sortActions(counts, c.order))
+	}
+}
+
+// TestGenerateSCPRemovesDuplicates tests that the same
+// action is only listed once
+func TestGenerateSCPRemovesDuplicates(t *testing.T) {
+	generated := generateSCP("Allow", permissions{
+		"s3":  {"GetObject": 2, "ListObjects": 2, "HeadBucket": 1},
+		"S3":  {"GetObject": 1, "ListBucket": 1},
+		"kms": {"Decrypt": 1},
+	}, sortByCount, defaultCatalog)
+	generatedAgain := generateSCP("Allow", permissions{
+		"kms": {"Decrypt": 1},
+		"S3":  {"GetObject": 1, "ListBucket": 1},
+		"s3":  {"GetObject": 2, "ListObjects": 2, "HeadBucket": 1},
+	}, sortByCount, defaultCatalog)
+
+	assert.Equal(t, []string{"s3:ListBucket", "s3:GetObject", "kms:Decrypt"}, []string(generated.Statement[0].Action))
+	assert.Equal(t, generated, generatedAgain)
+}
+
+// TestDedupeActions tests that differently cased actions
+// are counted together
+func TestDedupeActions(t *testing.T) {
+	deduped := dedupeActions(permissions{
+		"s3":  {"GetObject": 2, "getobject": 3},
+		"S3":  {"GetObject": 1},
+		"kms": {"Decrypt": 1},
+	})
+	assert.Equal(t, map[string]int64{"S3:GetObject": 6, "kms:Decrypt": 1}, deduped)
+}
+
+// TestCreateSCPFlagsUnknownActions tests that actions
+// missing from the catalog are reported, but not those
+// of services the catalog does not cover
+func TestCreateSCPFlagsUnknownActions(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.permissionSet = permissions{"s3": {"GetObject": 1, "tLifecycle": 1}, "xray": {"GetGroups": 1}}
+	messages := captureStderr(t)
+
+	err := testSCPRun.createSCP()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "warning: s3:tLifecycle is not in the action catalog\n", messages.String())
+}
+
+// TestGetCatalog tests that a catalog file replaces
+// the bundled catalog
+func TestGetCatalog(t *testing.T) {
+	defer func() { loadFile = ioutil.ReadFile }()
+	testSCPRun := getTestSCPRun()
+	testSCPRun.catalog = nil
+	err := testSCPRun.getCatalog()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCatalog, testSCPRun.catalog)
+
+	loadFile = func(filename string) ([]byte, error) {
+		return []byte(`{"s3": {"actions": ["GetObject"]}}`), nil
+	}
+	testSCPRun.catalogFilename = "catalog.json"
+	err = testSCPRun.getCatalog()
+	assert.Nil(t, err)
+	assert.Equal(t, actionCatalog{"s3": {Actions: []string{"GetObject"}}}, testSCPRun.catalog)
+
+	loadFile = func(filename string) ([]byte, error) {
+		return []byte(`["GetObject"]`), nil
+	}
+	assert.Error(t, testSCPRun.getCatalog())
+
+	loadFile = func(filename string) ([]byte, error) {
+		return nil, ErrInvalidParameters
+	}
+	assert.Equal(t, ErrInvalidParameters, testSCPRun.getCatalog())
+}
+
+// TestCreateSCPInvalidSortOrder tests that the sort
+// order is validated
+func TestCreateSCPInvalidSortOrder(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.sortOrder = "random"
+	err := testSCPRun.createSCP()
+	assert.Equal(t, ErrInvalidSortOrder, err)
+}
+
+// TestGenerateSCPGolden tests that generated policies are
+// byte identical to the golden files in testdata/golden.
+// Run go test -update to regenerate them.
+func TestGenerateSCPGolden(t *testing.T) {
+	cases := []struct {
+		golden   string
+		scpType  string
+		strategy selectionStrategy
+		order    string
+	}{
+		{
+			golden:   "allow_by_name.json",
+			scpType:  "Allow",
+			strategy: countStrategy{threshold: 2},
+			order:    sortByName,
+		},
+		{
+			golden:   "allow_by_count.json",
+			scpType:  "Allow",
+			strategy: countStrategy{threshold: 2},
+			order:    sortByCount,
+		},
+		{
+			golden:   "deny_by_name.json",
+			scpType:  "Deny",
+			strategy: inverseStrategy{countStrategy{threshold: 2}},
+			order:    sortByName,
+		},
+	}
+
+	usageData, err := ioutil.ReadFile("./testdata/s3_usage.json")
+	if err != nil {
+		t.Fatalf("could not read role usage test data")
+	}
+	reports, _ := decodeTestReports(usageData)
+	report := *reports
+
+	for _, c := range cases {
+		for i := 0; i < 5; i++ {
+			allowList := generateList(strategySet{fallback: c.strategy}, &report[0], defaultEventSources)
+			var output bytes.Buffer
+			stdout = &output
+			err := saveSCP(generateSCP(c.scpType, allowList, c.order, defaultCatalog), stdoutDestination, formatJSON, false)
+			stdout = os.Stdout
+			assert.Nil(t, err)
+
+			goldenFile := filepath.Join("testdata", "golden", c.golden)
+			if *update {
+				ioutil.WriteFile(goldenFile, output.Bytes(), 0644)
+			}
+			expected, _ := ioutil.ReadFile(goldenFile)
+			assert.Equal(t, string(expected), output.String(), c.golden)
+		}
+	}
 }
 
 //TestSaveSCP tests that we can save an SCP report
 func TestSaveSCP(t *testing.T) {
 	testSCP := getTestSCP("Allow", "S3")
+	destination := filepath.Join(t.TempDir(), "scp.json")
 
-	SCPSaved := saveSCP(testSCP)
+	SCPSaved := saveSCP(testSCP, destination, formatJSON, false)
 
 	assert.Nil(t, SCPSaved)
+	assert.FileExists(t, destination)
+}
+
+// TestSaveSCPToDirectory tests that the default file
+// name is used when the destination is a directory
+func TestSaveSCPToDirectory(t *testing.T) {
+	testSCP := getTestSCP("Allow", "S3")
+	destination := t.TempDir()
+
+	err := saveSCP(testSCP, destination, formatJSON, false)
+
+	assert.Nil(t, err)
+	assert.FileExists(t, filepath.Join(destination, defaultSCPFilename))
+}
+
+// TestSaveSCPYAML tests that the yaml format writes a
+// YAML policy into its own default file
+func TestSaveSCPYAML(t *testing.T) {
+	loadFile = ioutil.ReadFile
+	testSCP := getTestSCP("Allow", "S3")
+	destination := t.TempDir()
+
+	err := saveSCP(testSCP, destination, formatYAML, false)
+
+	assert.Nil(t, err)
+	saved, _ := ioutil.ReadFile(filepath.Join(destination, defaultSCPYAMLFilename))
+	assert.True(t, strings.HasPrefix(string(saved), "Version: \"2012-10-17\"\nStatement:\n"))
+	parsed, _ := loadSCP(filepath.Join(destination, defaultSCPYAMLFilename))
+	assert.Equal(t, testSCP, parsed)
+}
+
+// TestSaveSCPToStdout tests that - writes the SCP to stdout
+func TestSaveSCPToStdout(t *testing.T) {
+	testSCP := getTestSCP("Allow", "S3")
+	var output bytes.Buffer
+	stdout = &output
+	defer func() { stdout = os.Stdout }()
+
+	err := saveSCP(testSCP, stdoutDestination, formatJSON, false)
+
+	assert.Nil(t, err)
+	parsed, _ := parseSCP(output.Bytes())
+	assert.Equal(t, testSCP, parsed)
+}
+
+// TestSaveSCPRefusesOverwrite tests that an existing file
+// is only replaced when force is set
+func TestSaveSCPRefusesOverwrite(t *testing.T) {
+	testSCP := getTestSCP("Allow", "S3")
+	destination := filepath.Join(t.TempDir(), "scp.json")
+	ioutil.WriteFile(destination, []byte("existing"), 0644)
+
+	err := saveSCP(testSCP, destination, formatJSON, false)
+	existing, _ := ioutil.ReadFile(destination)
+
+	assert.Equal(t, ErrOutputExists, err)
+	assert.Equal(t, "existing", string(existing))
+
+	err = saveSCP(testSCP, destination, formatJSON, true)
+	overwritten, _ := ioutil.ReadFile(destination)
+
+	assert.Nil(t, err)
+	assert.NotEqual(t, "existing", string(overwritten))
+}
+
+// TestSaveSCPMinifiesLargePolicy tests that whitespace is
+// removed when the indented policy exceeds the size limit
+func TestSaveSCPMinifiesLargePolicy(t *testing.T) {
+	testSCP := generateSCP("Allow", getLargePermissions(170), sortByName, nil)
+	indented, _ := json.MarshalIndent(testSCP, "", " ")
+	destination := filepath.Join(t.TempDir(), "scp.json")
+
+	err := saveSCP(testSCP, destination, formatJSON, false)
+	saved, _ := ioutil.ReadFile(destination)
+
+	assert.Nil(t, err)
+	assert.True(t, len(indented) > maxSCPSize)
+	assert.Equal(t, scpSize(testSCP), len(saved))
+	assert.True(t, len(saved) <= maxSCPSize)
+}
+
+// TestFitSCP tests that empty SCPs are rejected and
+// oversized SCPs rejected or split according to the
+// oversize mode
+func TestFitSCP(t *testing.T) {
+	cases := []struct {
+		oversize  string
+		actions   int
+		documents int
+		expected  error
+	}{
+		{
+			oversize:  oversizeError,
+			actions:   10,
+			documents: 1,
+		},
+		{
+			oversize: oversizeError,
+			actions:  500,
+			expected: ErrSCPTooLarge,
+		},
+		{
+			oversize: oversizeCompact,
+			actions:  500,
+			expected: ErrSCPTooLarge,
+		},
+		{
+			oversize:  oversizeSplit,
+			actions:   500,
+			documents: 3,
+		},
+		{
+			oversize: oversizeSplit,
+			actions:  0,
+			expected: ErrEmptySCP,
+		},
+		{
+			oversize: "truncate",
+			actions:  10,
+			expected: ErrInvalidOversizeMode,
+		},
+	}
+
+	for _, c := range cases {
+		testSCPRun := getTestSCPRun()
+		testSCPRun.oversize = c.oversize
+		testSCPRun.permissionSet = getLargePermissions(c.actions)
+		testSCPRun.createSCP()
+
+		err := testSCPRun.fitSCP()
+
+		assert.Equal(t, c.expected, err)
+		if err == nil {
+			assert.Equal(t, c.documents, len(testSCPRun.documents))
+		}
+	}
+}
+
+// TestSaveSplitSCP tests that each document and the
+// manifest are written next to the destination
+func TestSaveSplitSCP(t *testing.T) {
+	testSCPRun := getTestSCPRun()
+	testSCPRun.oversize = oversizeSplit
+	testSCPRun.permissionSet = getLargePermissions(1000)
+	testSCPRun.outputLocation = t.TempDir()
+	testSCPRun.createSCP()
+	testSCPRun.fitSCP()
+	messages := captureStderr(t)
+	loadFile = ioutil.ReadFile
+
+	err := testSCPRun.saveSCP()
+
+	assert.Nil(t, err)
+	manifestData, _ := ioutil.ReadFile(filepath.Join(testSCPRun.outputLocation, "testSCP-manifest.json"))
+	manifest := splitManifest{}
+	json.Unmarshal(manifestData, &manifest)
+	assert.Equal(t, len(testSCPRun.documents), len(manifest.Documents))
+	assert.Contains(t, messages.String(), "warning")
+
+	total := 0
+	for i, entry := range manifest.Documents {
+		saved, loadErr := loadSCP(entry.File)
+		assert.Nil(t, loadErr)
+		assert.Equal(t, testSCPRun.documents[i], saved)
+		assert.Equal(t, []string(saved.Statement[0].Action), entry.Actions)
+		assert.True(t, entry.Size <= maxSCPSize)
+		total += len(entry.Actions)
+	}
+	assert.Equal(t, 1000, total)
+}
+
+// TestSaveSplitSCPErrors tests that split documents are not
+// written to stdout or over existing files
+func TestSaveSplitSCPErrors(t *testing.T) {
+	documents, _ := splitSCP(generateSCP("Allow", getLargePermissions(500), sortByName, nil), maxSCPSize)
+	destination := filepath.Join(t.TempDir(), "scp.json")
+	ioutil.WriteFile(numberedFilename(destination, "2"), []byte("existing"), 0644)
+	messages := captureStderr(t)
+
+	assert.Equal(t, ErrSplitToStdout, saveSplitSCP(documents, stdoutDestination, formatJSON, false))
+	assert.Equal(t, ErrOutputExists, saveSplitSCP(documents, destination, formatJSON, false))
+	assert.Contains(t, messages.String(), "scp-1.json: ")
+}
+
+// TestNumberedFilename tests that the suffix is
+// added before the extension
+func TestNumberedFilename(t *testing.T) {
+	assert.Equal(t, "out/scp-1.json", numberedFilename("out/scp.json", "1"))
+	assert.Equal(t, "scp-manifest", numberedFilename("scp", "manifest"))
+}
+
+// TestGetOutputLocation test that the output parameters are returned
+func TestGetOutputLocation(t *testing.T) {
+	testConfig := SCPConfig{Output: "-", Force: true}
+	assert.Equal(t, "-", *testConfig.outputLocation())
+	assert.True(t, *testConfig.forceOverwrite())
 }
 
 //TestGetSCPType test that the SCPType is returned
@@ -241,6 +819,42 @@ func TestGetThreshold(t *testing.T) {
 	assert.Equal(t, 34, int(*actual))
 }
 
+// TestGetStrategy test that the selection strategy is returned
+func TestGetStrategy(t *testing.T) {
+	testConfig := SCPConfig{Strategy: strategyPercent}
+	actual := testConfig.selectionStrategy()
+	assert.Equal(t, strategyPercent, *actual)
+}
+
+// TestGetThresholdsFilename test that the thresholds file is returned
+func TestGetThresholdsFilename(t *testing.T) {
+	testConfig := SCPConfig{Thresholds: "thresholds.yaml"}
+	actual := testConfig.thresholdsFilename()
+	assert.Equal(t, "thresholds.yaml", *actual)
+}
+
+// TestGetBaselineFilenames test that the baseline files are returned
+func TestGetBaselineFilenames(t *testing.T) {
+	testConfig := SCPConfig{Baseline: "baseline.yaml", Never: "never.yaml"}
+	assert.Equal(t, "baseline.yaml", *testConfig.baselineFilename())
+	assert.Equal(t, "never.yaml", *testConfig.neverFilename())
+}
+
+// TestGetReview test that the review parameters are returned
+func TestGetReview(t *testing.T) {
+	testConfig := SCPConfig{Review: "-", ReviewFmt: reviewHTML}
+	assert.Equal(t, "-", *testConfig.reviewLocation())
+	assert.Equal(t, reviewHTML, *testConfig.reviewFormat())
+}
+
+// TestGetOutputFormat test that the output format parameters are returned
+func TestGetOutputFormat(t *testing.T) {
+	testConfig := SCPConfig{Format: formatTerraform, Content: contentHeredoc, Name: "deny", Description: "denies", Targets: "r-ab12,ou-ab12-34567890"}
+	assert.Equal(t, formatTerraform, *testConfig.outputFormat())
+	assert.Equal(t, contentHeredoc, *testConfig.terraformContent())
+	assert.Equal(t, policyDetails{Name: "deny", Description: "denies", Targets: []string{"r-ab12", "ou-ab12-34567890"}}, testConfig.policyDetails())
+}
+
 //TestLoadScannerFileReturnsError test that an error is
 //returned
 func TestLoadScannerFileReturnsError(t *testing.T) {
@@ -344,7 +958,7 @@ func TestGetUsageDataValidPath(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return []byte("It Worked"), nil
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	err := testSCPRun.getUsageData()
 	assert.Nil(t, err)
 }
@@ -356,7 +970,7 @@ func TestGetUsageDataInvalidPath(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return nil, ErrInvalidParameters
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	err := testSCPRun.getUsageData()
 	assert.NotNil(t, err)
 }
@@ -367,7 +981,7 @@ func TestGetReportValidPath(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return []byte(getScannerMessage()), nil
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	testSCPRun.getUsageData()
 
 	err:= testSCPRun.getReport()
@@ -380,7 +994,7 @@ func TestGetReportInvalidPath(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return nil, ErrInvalidParameters
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	err:= testSCPRun.getReport()
 	assert.NotNil(t, err)
 }
@@ -392,7 +1006,7 @@ func TestCreatePermissionValidPath(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return []byte(getScannerMessage()), nil
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	usageErr := testSCPRun.getUsageData()
 
 	if usageErr != nil {
@@ -417,7 +1031,7 @@ func TestCreatePermissionAlternateValidPath(t *testing.T) {
 	loadFileMock := func(filename string)([]byte, error){
 		return []byte(getScannerMessage()), nil
 	}
-	loadFile = loadFileMock
+	mockOpenFile(t, loadFileMock)
 	usageErr := testSCPRun.getUsageData()
 
 	if usageErr != nil {
@@ -434,20 +1048,19 @@ func TestCreatePermissionAlternateValidPath(t *testing.T) {
 	assert.Nil(t, err)
 }
 
-
 //TestCreatePermissionsGeneratesErrorInvalidThresholds
 func TestCreatePermissionsGeneratesErrorInvalidThresholds(t *testing.T){
 	cases := []struct{
 		threshold int64
-		expected error
+		expected  error
 	}{
 		{
 			threshold: 0,
-			expected: ErrInvalidThreshold,
+			expected:  ErrInvalidThreshold,
 		},
 		{
 			threshold: -1,
-			expected: ErrInvalidThreshold,
+			expected:  ErrInvalidThreshold,
 		},
 	}
 
@@ -458,7 +1071,7 @@ func TestCreatePermissionsGeneratesErrorInvalidThresholds(t *testing.T){
 		loadFileMock := func(filename string)([]byte, error){
 			return []byte(getScannerMessage()), nil
 		}
-		loadFile = loadFileMock
+		mockOpenFile(t, loadFileMock)
 		usageErr := testSCPRun.getUsageData()
 
 		if usageErr != nil {
@@ -476,13 +1089,67 @@ func TestCreatePermissionsGeneratesErrorInvalidThresholds(t *testing.T){
 	}
 }
 
+// mockOpenFile opens scanner files with a file loader
+// for the rest of a test
+func mockOpenFile(t *testing.T, load fileLoader) {
+	openFile = func(filename string) (io.ReadCloser, error) {
+		data, err := load(filename)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	t.Cleanup(func() {
+		openFile = func(filename string) (io.ReadCloser, error) { return os.Open(filename) }
+	})
+}
+
+// decodeTestReports decodes a scanner report or CSV
+// query result into its reports
+func decodeTestReports(usageData []byte) (*[]Report, error) {
+	v := []Report{}
+	if err := decodeUsage(bytes.NewReader(usageData), func(r Report) {
+		v = append(v, r)
+	}); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// aggregateReports collects reports into a usage dataset
+func aggregateReports(reports []Report) *usageAggregator {
+	usage := newUsageAggregator()
+	for _, r := range reports {
+		usage.add(r)
+	}
+	return usage
+}
+
+// captureStderr collects the warnings written during a test
+func captureStderr(t *testing.T) *bytes.Buffer {
+	var messages bytes.Buffer
+	previous := stderr
+	stderr = &messages
+	t.Cleanup(func() { stderr = previous })
+	return &messages
+}
+
 //Returns a test SCP Run object
 func getTestSCPRun() SCPRun {
 	testSCPRun := SCPRun{thresholdLimit: 10,
 		scannerFilename: "testFile",
-		serviceType: "Allow"}
+		serviceType:     "Allow",
+		strategy:        strategyCount,
+		format:          formatJSON,
+		mergeMode:       mergeSum,
+		sortOrder:       sortByName,
+		oversize:        oversizeCompact,
+		catalog:         defaultCatalog,
+		sources:         defaultEventSources,
+		unknownSource:   unknownSourceWarn}
 	return testSCPRun
 }
+
 //JSONFileDataStub
 type jsonFileStub struct {
 	inputData string
@@ -497,7 +1164,7 @@ func getCorruptedScannerMessage() string {
 	scannerMessage := `
 [
    "rresults": {
-      "event_source": "s3.amazon.com",
+      "event_source": "s3.amazonaws.com",
       "service_usage": [
         {
           "event_name": "ListObjectVersions",
@@ -562,7 +1229,7 @@ func getScannerMessage() string {
       "month": "03"
     },
     "results": {
-      "event_source": "s3.amazon.com",
+      "event_source": "s3.amazonaws.com",
       "service_usage": [
         {
           "event_name": "ListObjectVersions",
@@ -634,12 +1301,111 @@ func getTestReport() *[]Report {
 	jsonData := getScannerMessage()
 	testStub := jsonFileStub{inputData: jsonData}
 	testData := testStub.getData()
-	report, _ := generateReport(testData)
+	report, _ := decodeTestReports(testData)
 	return report
 }
 
 func getTestSCP(scpType string, awsService string) SCP {
 	allowList := getTestAllowListFilteredData()
-	testSCP := generateSCP(scpType, awsService, allowList)
+	testSCP := generateSCP(scpType, permissions{awsService: allowList}, sortByName, nil)
 	return testSCP
 }
+
+// getMultiAccountReports returns reports for two accounts,
+// one of which is split across two service reports
+func getMultiAccountReports() []Report {
+	jsonData := `
+[
+  {
+    "account": {"identifier": "638924580364", "name": "webops users"},
+    "results": {
+      "event_source": "s3.amazonaws.com",
+      "service_usage": [
+        {"event_name": "ListBuckets", "count": 145},
+        {"event_name": "GetObject", "count": 231}
+      ]
+    }
+  },
+  {
+    "account": {"identifier": "132732819912", "name": "platsec-development"},
+    "results": {
+      "event_source": "s3.amazonaws.com",
+      "service_usage": [
+        {"event_name": "ListBuckets", "count": 5},
+        {"event_name": "PutObject", "count": 4}
+      ]
+    }
+  },
+  {
+    "account": {"identifier": "132732819912", "name": "platsec-development"},
+    "results": {
+      "role_usage": [
+        {"event_source": "s3.amazonaws.com", "event_name": "PutObject", "count": 4}
+      ]
+    }
+  },
+  {
+    "account": {"identifier": "638924580364", "name": "webops users"},
+    "results": {
+      "role_usage": [
+        {"event_source": "s3.amazonaws.com", "event_name": "PutObject", "count": 4}
+      ]
+    }
+  }
+]
+`
+	reports, _ := decodeTestReports([]byte(jsonData))
+	return *reports
+}
+
+// getLargePermissions returns a permission set with
+// the given number of made up s3 actions
+func getLargePermissions(actions int) permissions {
+	largePermissions := permissions{}
+	for i := 0; i < actions; i++ {
+		largePermissions.add("s3", fmt.Sprintf("GetObjectAttribute%04d", i), int64(i))
+	}
+	return largePermissions
+}
+
+// getRoleUsageReport returns a decoded role_usage report
+// covering several services
+func getRoleUsageReport() Report {
+	jsonData := `
+[
+  {
+    "account": {
+      "identifier": "132732819912",
+      "name": "platsec-development"
+    },
+    "description": "AWS RoleSecurityReadOnly usage scan",
+    "partition": {
+      "year": "2021",
+      "month": "03"
+    },
+    "results": {
+      "role_usage": [
+        {
+          "event_source": "cloudformation.amazonaws.com",
+          "event_name": "DescribeStackResources",
+          "count": 9
+        },
+        {
+          "event_source": "kms.amazonaws.com",
+          "event_name": "Decrypt",
+          "count": 1
+        },
+        {
+          "event_source": "s3.amazonaws.com",
+          "event_name": "GetBucketAcl",
+          "count": 4
+        }
+      ]
+    }
+  }
+]
+`
+	reports, _ := decodeTestReports([]byte(jsonData))
+	report := *reports
+	return report[0]
+}
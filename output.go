@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Output formats
+const (
+	formatJSON               = "json"
+	formatYAML               = "yaml"
+	formatTerraform          = "terraform"
+	formatCloudFormation     = "cloudformation"
+	formatCloudFormationJSON = "cloudformation-json"
+)
+
+var ErrInvalidFormat = errors.New("format must be json, yaml, terraform, cloudformation or cloudformation-json")
+
+// Default filenames of a policy used when the
+// destination is a directory
+const (
+	defaultSCPFilename     = "testSCP.json"
+	defaultSCPYAMLFilename = "testSCP.yaml"
+)
+
+// scpFilename returns the default filename of a
+// policy written in the format
+func scpFilename(format string) string {
+	switch format {
+	case formatYAML:
+		return defaultSCPYAMLFilename
+	case formatTerraform:
+		return defaultTerraformFilename
+	case formatCloudFormation:
+		return defaultCloudFormationFilename
+	case formatCloudFormationJSON:
+		return defaultCloudFormationJSONFilename
+	}
+	return defaultSCPFilename
+}
+
+// policyDetails describes a policy to the tools that
+// deploy it
+type policyDetails struct {
+	Name        string
+	Description string
+	Targets     []string
+}
+
+// parseTargets splits a comma separated list of
+// organizational unit, account or root ids, dropping
+// blanks and repeated ids
+func parseTargets(targets string) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(targets, ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// policyVersion is the current AWS policy language version
+const policyVersion = "2012-10-17"
+
+// AWS Organizations quotas for service control policies
+const (
+	maxSCPSize       = 5120
+	maxSCPsPerTarget = 5
+)
+
+// Oversized SCP handling modes
+const (
+	oversizeError   = "error"
+	oversizeCompact = "compact"
+	oversizeSplit   = "split"
+)
+
+var ErrInvalidPolicy = errors.New("policy document has no Version or Statement")
+var ErrSCPTooLarge = errors.New("scp exceeds the 5120 character size limit")
+var ErrPolicyProblems = errors.New("policy has problems")
+var ErrEmptySCP = errors.New("scp has no actions, no api call was selected")
+
+// SCP is a struct representing a AWS SCP document. Its
+// fields are written in the same order as JSON and YAML.
+type SCP struct {
+	Version   string     `json:"Version" yaml:"Version"`
+	Statement Statements `json:"Statement" yaml:"Statement"`
+}
+
+// Statements is the Statement list of a policy. A single
+// statement object is also accepted when parsing.
+type Statements []Statement
+
+// Statement is a single statement of a policy document
+type Statement struct {
+	Sid         string                            `json:"Sid,omitempty" yaml:"Sid,omitempty"`
+	Effect      string                            `json:"Effect" yaml:"Effect"`
+	Action      StringList                        `json:"Action,omitempty" yaml:"Action,omitempty"`
+	NotAction   StringList                        `json:"NotAction,omitempty" yaml:"NotAction,omitempty"`
+	Resource    StringList                        `json:"Resource,omitempty" yaml:"Resource,omitempty"`
+	NotResource StringList                        `json:"NotResource,omitempty" yaml:"NotResource,omitempty"`
+	Condition   map[string]map[string]interface{} `json:"Condition,omitempty" yaml:"Condition,omitempty"`
+}
+
+// StringList is a policy element that can be written
+// as either a single string or a list of strings
+type StringList []string
+
+// UnmarshalJSON accepts a single statement object
+// as well as a list of statements
+func (s *Statements) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var statement Statement
+		if err := json.Unmarshal(data, &statement); err != nil {
+			return err
+		}
+		*s = Statements{statement}
+		return nil
+	}
+
+	var statements []Statement
+	if err := json.Unmarshal(data, &statements); err != nil {
+		return err
+	}
+	*s = statements
+	return nil
+}
+
+// UnmarshalJSON accepts a single string as well
+// as a list of strings
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		*l = StringList{value}
+		return nil
+	}
+
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*l = values
+	return nil
+}
+
+// UnmarshalYAML accepts a single statement mapping
+// as well as a list of statements
+func (s *Statements) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		var statement Statement
+		if err := node.Decode(&statement); err != nil {
+			return err
+		}
+		*s = Statements{statement}
+		return nil
+	}
+
+	var statements []Statement
+	if err := node.Decode(&statements); err != nil {
+		return err
+	}
+	*s = statements
+	return nil
+}
+
+// UnmarshalYAML accepts a single string as well
+// as a list of strings
+func (l *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = StringList{node.Value}
+		return nil
+	}
+
+	var values []string
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	*l = values
+	return nil
+}
+
+// parseSCP reads a JSON or YAML policy document back
+// into the SCP model
+func parseSCP(data []byte) (SCP, error) {
+	var scp SCP
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, &scp)
+	} else {
+		err = yaml.Unmarshal(data, &scp)
+	}
+	if err != nil {
+		return SCP{}, err
+	}
+
+	if scp.Version == "" || len(scp.Statement) == 0 {
+		return SCP{}, ErrInvalidPolicy
+	}
+	return scp, nil
+}
+
+// loadSCP loads an existing policy file
+func loadSCP(filename string) (SCP, error) {
+	policyData, err := loadFile(filename)
+	if err != nil {
+		return SCP{}, err
+	}
+	return parseSCP(policyData)
+}
+
+// marshalSCP writes the policy as indented JSON, or as
+// YAML for the yaml format. The whitespace is removed from
+// JSON when the indented document would not fit within the
+// size limit.
+func marshalSCP(scp SCP, format string) ([]byte, error) {
+	if format == formatYAML {
+		var output bytes.Buffer
+		encoder := yaml.NewEncoder(&output)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(scp); err != nil {
+			return nil, err
+		}
+		encoder.Close()
+		return bytes.TrimSuffix(output.Bytes(), []byte("\n")), nil
+	}
+
+	jsonData, err := json.MarshalIndent(scp, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonData) > maxSCPSize {
+		jsonData, _ = json.Marshal(scp)
+	}
+	return jsonData, nil
+}
+
+// scpSize returns the number of characters in the
+// policy once all whitespace has been removed
+func scpSize(scp SCP) int {
+	jsonData, _ := json.Marshal(scp)
+	return len(jsonData)
+}
+
+// splitSCP splits the actions of a single statement policy
+// across as many documents as are needed to keep each one
+// within the size limit
+func splitSCP(scp SCP, limit int) ([]SCP, error) {
+	statement := scp.Statement[0]
+	newDocument := func(part int) SCP {
+		s := statement
+		s.Sid = statement.Sid + strconv.Itoa(part)
+		s.Action = nil
+		return SCP{Version: scp.Version, Statement: Statements{s}}
+	}
+
+	documents := []SCP{newDocument(1)}
+	for _, action := range statement.Action {
+		current := &documents[len(documents)-1].Statement[0]
+		current.Action = append(current.Action, action)
+		if scpSize(documents[len(documents)-1]) <= limit {
+			continue
+		}
+
+		current.Action = current.Action[:len(current.Action)-1]
+		next := newDocument(len(documents) + 1)
+		next.Statement[0].Action = StringList{action}
+		if len(current.Action) == 0 || scpSize(next) > limit {
+			return nil, ErrSCPTooLarge
+		}
+		documents = append(documents, next)
+	}
+	return documents, nil
+}
+
+// validateSCP returns every way the policy breaks the
+// rules AWS Organizations applies to service control
+// policies. A valid policy has no problems.
+func validateSCP(scp SCP) []string {
+	var problems []string
+	if scp.Version != policyVersion {
+		problems = append(problems, fmt.Sprintf("Version must be %s", policyVersion))
+	}
+
+	sids := map[string]bool{}
+	for i, statement := range scp.Statement {
+		name := fmt.Sprintf("statement %d", i+1)
+		if statement.Sid != "" {
+			name = fmt.Sprintf("statement %s", statement.Sid)
+			if sids[statement.Sid] {
+				problems = append(problems, fmt.Sprintf("%s: Sid is used by more than one statement", name))
+			}
+			sids[statement.Sid] = true
+		}
+
+		if statement.Effect != "Allow" && statement.Effect != "Deny" {
+			problems = append(problems, fmt.Sprintf("%s: Effect must be Allow or Deny", name))
+		}
+		if len(statement.Action) == 0 && len(statement.NotAction) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: has no Action or NotAction", name))
+		}
+		if len(statement.Action) > 0 && len(statement.NotAction) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: has both Action and NotAction", name))
+		}
+		if len(statement.Resource) > 0 && len(statement.NotResource) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: has both Resource and NotResource", name))
+		}
+		for _, action := range append(append([]string{}, statement.Action...), statement.NotAction...) {
+			if action == "*" {
+				continue
+			}
+			if parts := strings.SplitN(action, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				problems = append(problems, fmt.Sprintf("%s: %q is not written as service:Action", name, action))
+			}
+		}
+	}
+
+	if size := scpSize(scp); size > maxSCPSize {
+		problems = append(problems, fmt.Sprintf("%d characters exceeds the %d character size limit", size, maxSCPSize))
+	}
+	return problems
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMarshalSCP tests that a generated SCP is written
+// with a Statement array and a per statement Resource
+func TestMarshalSCP(t *testing.T) {
+	generated := generateSCP("Allow", permissions{"s3": {"GetObject": 10}}, sortByName, nil)
+	jsonData, err := json.Marshal(generated)
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Sid": "AllowScannerUsage",
+				"Effect": "Allow",
+				"Action": ["s3:GetObject"],
+				"Resource": ["*"]
+			}
+		]
+	}`, string(jsonData))
+}
+
+// TestParseSCPRoundTrip tests that a generated SCP can
+// be read back into the same types
+func TestParseSCPRoundTrip(t *testing.T) {
+	generated := getTestSCP("Allow", "s3")
+	jsonData, _ := json.MarshalIndent(generated, "", " ")
+
+	parsed, err := parseSCP(jsonData)
+
+	assert.Nil(t, err)
+	assert.Equal(t, generated, parsed)
+}
+
+// TestParseSCPShorthand tests that a single statement
+// object and single string elements are accepted
+func TestParseSCPShorthand(t *testing.T) {
+	policy := `{
+		"Version": "2012-10-17",
+		"Statement": {
+			"Effect": "Deny",
+			"NotAction": "iam:*",
+			"NotResource": "arn:aws:iam::*:role/breakglass",
+			"Condition": {
+				"StringNotEquals": {"aws:RequestedRegion": ["eu-west-2", "us-east-1"]},
+				"Bool": {"aws:SecureTransport": false}
+			}
+		}
+	}`
+
+	parsed, err := parseSCP([]byte(policy))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(parsed.Statement))
+	assert.Equal(t, "Deny", parsed.Statement[0].Effect)
+	assert.Equal(t, StringList{"iam:*"}, parsed.Statement[0].NotAction)
+	assert.Equal(t, StringList{"arn:aws:iam::*:role/breakglass"}, parsed.Statement[0].NotResource)
+	assert.Equal(t, false, parsed.Statement[0].Condition["Bool"]["aws:SecureTransport"])
+}
+
+// TestParseSCPErrors tests that malformed and empty
+// policies are rejected
+func TestParseSCPErrors(t *testing.T) {
+	cases := []struct {
+		policy   string
+		expected error
+	}{
+		{
+			policy:   `{"Version": "2012-10-17", "Statement": []}`,
+			expected: ErrInvalidPolicy,
+		},
+		{
+			policy:   `{"Statement": [{"Effect": "Allow", "Action": "s3:*"}]}`,
+			expected: ErrInvalidPolicy,
+		},
+	}
+
+	for _, c := range cases {
+		_, err := parseSCP([]byte(c.policy))
+		assert.Equal(t, c.expected, err)
+	}
+
+	invalid := []string{
+		`{"Version": "2012-10-17", "Statement": {"Action": 1}}`,
+		`{"Version": "2012-10-17", "Statement": "Allow"}`,
+		`{"Version": "2012-10-17", "Statement": [{"Action": [1]}]}`,
+		`{"Version": "2012-10-17"`,
+	}
+	for _, policy := range invalid {
+		_, err := parseSCP([]byte(policy))
+		assert.Error(t, err)
+	}
+}
+
+// TestMarshalSCPYAML tests that a YAML policy keeps
+// the key order of the JSON policy
+func TestMarshalSCPYAML(t *testing.T) {
+	generated := generateSCP("Deny", permissions{"s3": {"PutObject": 1, "DeleteObject": 1}}, sortByName, nil)
+
+	yamlData, err := marshalSCP(generated, formatYAML)
+
+	assert.Nil(t, err)
+	assert.Equal(t, `Version: "2012-10-17"
+Statement:
+  - Sid: DenyScannerUsage
+    Effect: Deny
+    Action:
+      - s3:DeleteObject
+      - s3:PutObject
+    Resource:
+      - '*'`, string(yamlData))
+}
+
+// TestParseSCPYAML tests that a YAML policy is read
+// into the same model as its JSON form
+func TestParseSCPYAML(t *testing.T) {
+	loadFile = ioutil.ReadFile
+	jsonPolicy, _ := loadSCP("./testdata/golden/allow_by_name.json")
+
+	yamlPolicy, err := loadSCP("./testdata/golden/allow_by_name.yaml")
+
+	assert.Nil(t, err)
+	assert.Equal(t, jsonPolicy, yamlPolicy)
+
+	yamlData, _ := marshalSCP(yamlPolicy, formatYAML)
+	parsed, err := parseSCP(yamlData)
+	assert.Nil(t, err)
+	assert.Equal(t, yamlPolicy, parsed)
+}
+
+// TestParseSCPYAMLShorthand tests that a single statement
+// mapping, single string elements and an unquoted version
+// are accepted
+func TestParseSCPYAMLShorthand(t *testing.T) {
+	policy := `Version: 2012-10-17
+Statement:
+  Effect: Deny
+  NotAction: iam:*
+  NotResource: arn:aws:iam::*:role/breakglass
+  Condition:
+    StringNotEquals:
+      aws:RequestedRegion: [eu-west-2, us-east-1]
+    Bool:
+      aws:SecureTransport: false
+`
+
+	parsed, err := parseSCP([]byte(policy))
+
+	assert.Nil(t, err)
+	assert.Equal(t, policyVersion, parsed.Version)
+	assert.Equal(t, 1, len(parsed.Statement))
+	assert.Equal(t, "Deny", parsed.Statement[0].Effect)
+	assert.Equal(t, StringList{"iam:*"}, parsed.Statement[0].NotAction)
+	assert.Equal(t, StringList{"arn:aws:iam::*:role/breakglass"}, parsed.Statement[0].NotResource)
+	assert.Equal(t, false, parsed.Statement[0].Condition["Bool"]["aws:SecureTransport"])
+
+	for _, invalid := range []string{"Version: 2012-10-17\nStatement: []\n", "Statement:\n  Effect: Allow\n", "- Version\n", "Statement: [\n"} {
+		_, err := parseSCP([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+// TestLoadSCP tests that an existing policy file can be loaded
+func TestLoadSCP(t *testing.T) {
+	loadFile = ioutil.ReadFile
+	scp, err := loadSCP("./testdata/testSCP.json")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Allow", scp.Statement[0].Effect)
+	assert.Equal(t, 3, len(scp.Statement[0].Action))
+
+	_, err = loadSCP("./testdata/missing.json")
+	assert.Error(t, err)
+}
+
+// TestSCPSize tests that the size excludes whitespace
+func TestSCPSize(t *testing.T) {
+	generated := generateSCP("Allow", permissions{"s3": {"GetObject": 10}}, sortByName, nil)
+	minified := `{"Version":"2012-10-17","Statement":[{"Sid":"AllowScannerUsage","Effect":"Allow","Action":["s3:GetObject"],"Resource":["*"]}]}`
+	assert.Equal(t, len(minified), scpSize(generated))
+}
+
+// TestSplitSCP tests that the actions are spread over
+// documents that each fit within the limit
+func TestSplitSCP(t *testing.T) {
+	generated := generateSCP("Deny", getLargePermissions(500), sortByName, nil)
+
+	documents, err := splitSCP(generated, maxSCPSize)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(documents))
+
+	var actions []string
+	for i, document := range documents {
+		assert.True(t, scpSize(document) <= maxSCPSize)
+		assert.Equal(t, "Deny", document.Statement[0].Effect)
+		assert.Equal(t, StringList{"*"}, document.Statement[0].Resource)
+		assert.Equal(t, "DenyScannerUsage"+strconv.Itoa(i+1), document.Statement[0].Sid)
+		actions = append(actions, document.Statement[0].Action...)
+	}
+	assert.Equal(t, []string(generated.Statement[0].Action), actions)
+}
+
+// TestSplitSCPActionTooLarge tests that an error is returned
+// when a single action can not fit in a document
+func TestSplitSCPActionTooLarge(t *testing.T) {
+	generated := generateSCP("Allow", permissions{"s3": {"GetObject": 1, "PutObject": 1}}, sortByName, nil)
+
+	_, err := splitSCP(generated, 100)
+
+	assert.Equal(t, ErrSCPTooLarge, err)
+}
+
+// TestValidateSCP tests that every rule a policy
+// breaks is reported
+func TestValidateSCP(t *testing.T) {
+	valid := generateSCP("Allow", permissions{"s3": {"GetObject": 1}}, sortByName, nil)
+	assert.Empty(t, validateSCP(valid))
+
+	invalid := SCP{Version: "2008-10-17", Statement: Statements{
+		{Sid: "Same", Effect: "allow", Action: StringList{"s3:GetObject"}, NotAction: StringList{"GetObject"}},
+		{Sid: "Same", Effect: "Deny", Resource: StringList{"*"}, NotResource: StringList{"arn:aws:s3:::bucket"}},
+		{Effect: "Deny", Action: StringList{"*", "s3:"}},
+	}}
+
+	assert.Equal(t, []string{
+		"Version must be 2012-10-17",
+		"statement Same: Effect must be Allow or Deny",
+		"statement Same: has both Action and NotAction",
+		`statement Same: "GetObject" is not written as service:Action`,
+		"statement Same: Sid is used by more than one statement",
+		"statement Same: has no Action or NotAction",
+		"statement Same: has both Resource and NotResource",
+		`statement 3: "s3:" is not written as service:Action`,
+	}, validateSCP(invalid))
+
+	oversized := generateSCP("Deny", getLargePermissions(500), sortByName, nil)
+	assert.Equal(t, []string{fmt.Sprintf("%d characters exceeds the 5120 character size limit", scpSize(oversized))}, validateSCP(oversized))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Review report formats
+const (
+	reviewMarkdown = "markdown"
+	reviewHTML     = "html"
+)
+
+// Default review report filenames used when the
+// destination is a directory
+const (
+	defaultReviewMarkdown = "testSCP-review.md"
+	defaultReviewHTML     = "testSCP-review.html"
+)
+
+var ErrInvalidReviewFormat = errors.New("review format must be markdown or html")
+
+// review is the content of a review report, written for
+// teams discussing a generated SCP
+type review struct {
+	Effect   string
+	Sources  []reportSource
+	Services []serviceReview
+	Included []string
+	Excluded []decision
+	Policies []string
+}
+
+// serviceReview is the usage of a single service
+type serviceReview struct {
+	Name      string
+	Decisions []decision
+}
+
+// newReview builds a review from the reports that were
+// loaded, the decision made about each api call and the
+// resulting policy documents
+func newReview(sources []reportSource, decisions []decision, documents []SCP) review {
+	r := review{Sources: sources}
+
+	services := map[string]*serviceReview{}
+	var names []string
+	for _, d := range decisions {
+		name := d.Service
+		if name == "" {
+			name = d.EventSource
+		}
+		if _, ok := services[name]; !ok {
+			services[name] = &serviceReview{Name: name}
+			names = append(names, name)
+		}
+		services[name].Decisions = append(services[name].Decisions, d)
+		if !d.Included {
+			r.Excluded = append(r.Excluded, d)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.Services = append(r.Services, *services[name])
+	}
+
+	for _, scp := range documents {
+		r.Effect = policyEffect(scp)
+		for _, statement := range scp.Statement {
+			r.Included = append(r.Included, statement.Action...)
+		}
+		jsonData, _ := json.MarshalIndent(scp, "", " ")
+		r.Policies = append(r.Policies, string(jsonData))
+	}
+	return r
+}
+
+// renderReview renders the review as markdown or
+// as a self contained html page
+func renderReview(r review, format string) ([]byte, error) {
+	var output bytes.Buffer
+	var err error
+	switch format {
+	case reviewMarkdown:
+		err = markdownReview.Execute(&output, r)
+	case reviewHTML:
+		err = htmlReview.Execute(&output, r)
+	default:
+		return nil, ErrInvalidReviewFormat
+	}
+	return output.Bytes(), err
+}
+
+var reviewFuncs = map[string]interface{}{
+	"outcome": func(d decision) string {
+		return d.outcome()
+	},
+	"eventNames": func(d decision) string {
+		return d.eventNames()
+	},
+	"md": func(s string) string {
+		return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+	},
+}
+
+var markdownReview = template.Must(template.New("markdown").Funcs(reviewFuncs).Parse(`# Service control policy review
+
+Effect: {{.Effect}}
+
+## Scanner reports
+
+| Account | Name | Principal | Year | Month | Reports | Calls | Description |
+|---------|------|-----------|------|-------|---------|-------|-------------|
+{{range .Sources}}| {{md .AccountID}} | {{md .AccountName}} | {{md .Principal}} | {{md .Year}} | {{md .Month}} | {{.Reports}} | {{.Calls}} | {{md .Description}} |
+{{end}}
+## Usage by service
+{{range .Services}}
+### {{md .Name}}
+
+| Action | Event names | Count | Strategy | Threshold | Outcome | Override |
+|--------|-------------|-------|----------|-----------|---------|----------|
+{{range .Decisions}}| {{md .Action}} | {{md (eventNames .)}} | {{.Count}} | {{or .Strategy "-"}} | {{if .Strategy}}{{.Threshold}}{{else}}-{{end}} | {{outcome .}} | {{md .Override}} |
+{{end}}{{end}}
+## Included actions
+
+{{range .Included}}- ` + "`{{.}}`" + `
+{{else}}None
+{{end}}
+## Excluded api calls
+
+{{range .Excluded}}- ` + "`{{.Action}}`" + ` ({{.Count}} calls){{if .Override}}: {{.Override}}{{end}}
+{{else}}None
+{{end}}
+## Policy
+{{range .Policies}}
+` + "```json\n{{.}}\n```" + `
+{{end}}`))
+
+var htmlReview = htmltemplate.Must(htmltemplate.New("html").Funcs(reviewFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Service control policy review</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #0b0c0c; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #b1b4b6; padding: 0.3em 0.6em; text-align: left; }
+th { background: #f3f2f1; }
+td.count { text-align: right; }
+tr.excluded { color: #505a5f; }
+pre { background: #f3f2f1; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Service control policy review</h1>
+<p>Effect: {{.Effect}}</p>
+<h2>Scanner reports</h2>
+<table>
+<tr><th>Account</th><th>Name</th><th>Principal</th><th>Year</th><th>Month</th><th>Reports</th><th>Calls</th><th>Description</th></tr>
+{{range .Sources}}<tr><td>{{.AccountID}}</td><td>{{.AccountName}}</td><td>{{.Principal}}</td><td>{{.Year}}</td><td>{{.Month}}</td><td class="count">{{.Reports}}</td><td class="count">{{.Calls}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+<h2>Usage by service</h2>
+{{range .Services}}<h3>{{.Name}}</h3>
+<table>
+<tr><th>Action</th><th>Event names</th><th>Count</th><th>Strategy</th><th>Threshold</th><th>Outcome</th><th>Override</th></tr>
+{{range .Decisions}}<tr{{if not .Included}} class="excluded"{{end}}><td>{{.Action}}</td><td>{{eventNames .}}</td><td class="count">{{.Count}}</td><td>{{or .Strategy "-"}}</td><td>{{if .Strategy}}{{.Threshold}}{{else}}-{{end}}</td><td>{{outcome .}}</td><td>{{.Override}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Included actions</h2>
+<ul>
+{{range .Included}}<li><code>{{.}}</code></li>
+{{else}}<li>None</li>
+{{end}}</ul>
+<h2>Excluded api calls</h2>
+<ul>
+{{range .Excluded}}<li><code>{{.Action}}</code> ({{.Count}} calls){{if .Override}}: {{.Override}}{{end}}</li>
+{{else}}<li>None</li>
+{{end}}</ul>
+<h2>Policy</h2>
+{{range .Policies}}<pre>{{.}}</pre>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestReview returns a review of a small allow SCP
+func getTestReview() review {
+	sources := []reportSource{{AccountID: "999888777666", AccountName: "team|a", Year: "2021", Month: "03", Description: "usage scan", Reports: 2, Calls: 237}}
+	decisions := []decision{
+		{Service: "s3", EventSource: "s3.amazonaws.com", Action: "s3:GetObject", EventNames: []string{"GetObject", "CopyObject"}, Count: 231, Strategy: strategyCount, Threshold: 10, Selected: true, Included: true},
+		{Service: "s3", EventSource: "s3.amazonaws.com", Action: "s3:GetBucketNotification", Count: 1, Strategy: strategyCount, Threshold: 10},
+		{EventSource: "unknown.amazonaws.com", Action: "GetThing", Count: 5, Override: "unknown event source"},
+		{Service: "sts", Action: "sts:AssumeRole", Override: "included by the baseline: <break glass>", Included: true},
+	}
+	scp := generateSCP("Allow", permissions{"s3": {"GetObject": 231}, "sts": {"AssumeRole": 0}}, sortByName, nil)
+	return newReview(sources, decisions, []SCP{scp})
+}
+
+// TestNewReview tests that decisions are grouped by
+// service and the policy actions collected
+func TestNewReview(t *testing.T) {
+	r := getTestReview()
+
+	assert.Equal(t, "Allow", r.Effect)
+	assert.Equal(t, []string{"s3", "sts", "unknown.amazonaws.com"}, []string{r.Services[0].Name, r.Services[1].Name, r.Services[2].Name})
+	assert.Len(t, r.Services[0].Decisions, 2)
+	assert.Equal(t, []string{"s3:GetObject", "sts:AssumeRole"}, r.Included)
+	assert.Equal(t, []string{"s3:GetBucketNotification", "GetThing"}, []string{r.Excluded[0].Action, r.Excluded[1].Action})
+	assert.Len(t, r.Policies, 1)
+}
+
+// TestRenderReviewMarkdown tests the markdown report
+func TestRenderReviewMarkdown(t *testing.T) {
+	data, err := renderReview(getTestReview(), reviewMarkdown)
+	markdown := string(data)
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(markdown, "# Service control policy review\n"))
+	assert.Contains(t, markdown, "| 999888777666 | team\\|a |  | 2021 | 03 | 2 | 237 | usage scan |\n")
+	assert.Contains(t, markdown, "### s3\n")
+	assert.Contains(t, markdown, "| s3:GetObject | GetObject, CopyObject | 231 | count | 10 | in scp |  |\n")
+	assert.Contains(t, markdown, "| sts:AssumeRole | - | 0 | - | - | in scp | included by the baseline: <break glass> |\n")
+	assert.Contains(t, markdown, "- `s3:GetBucketNotification` (1 calls)\n")
+	assert.Contains(t, markdown, "- `GetThing` (5 calls): unknown event source\n")
+	assert.Contains(t, markdown, "```json\n{\n \"Version\": \"2012-10-17\",")
+}
+
+// TestRenderReviewHTML tests that the html report is a
+// self contained page with its content escaped
+func TestRenderReviewHTML(t *testing.T) {
+	data, err := renderReview(getTestReview(), reviewHTML)
+	html := string(data)
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(html, "<!DOCTYPE html>"))
+	assert.Contains(t, html, "<style>")
+	assert.NotContains(t, html, "<link")
+	assert.Contains(t, html, "<td>team|a</td>")
+	assert.Contains(t, html, `<tr class="excluded"><td>s3:GetBucketNotification</td><td>-</td>`)
+	assert.Contains(t, html, "<td>s3:GetObject</td><td>GetObject, CopyObject</td>")
+	assert.Contains(t, html, "included by the baseline: &lt;break glass&gt;")
+	assert.Contains(t, html, "&#34;Version&#34;: &#34;2012-10-17&#34;")
+}
+
+// TestRenderReviewEmpty tests a review with nothing in it
+func TestRenderReviewEmpty(t *testing.T) {
+	markdown, _ := renderReview(newReview(nil, nil, nil), reviewMarkdown)
+	html, _ := renderReview(newReview(nil, nil, nil), reviewHTML)
+
+	assert.Contains(t, string(markdown), "## Included actions\n\nNone\n")
+	assert.Contains(t, string(html), "<li>None</li>")
+}
+
+// TestRenderReviewInvalidFormat tests that an unknown
+// format is rejected
+func TestRenderReviewInvalidFormat(t *testing.T) {
+	_, err := renderReview(getTestReview(), "pdf")
+	assert.Equal(t, ErrInvalidReviewFormat, err)
+}
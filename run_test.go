@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestSCPConfig returns the flag defaults reading the
+// given scanner file and writing into a temporary directory
+func getTestSCPConfig(t *testing.T, scannerFile string) *SCPConfig {
+	loadFile = ioutil.ReadFile
+	return &SCPConfig{
+		SCPType:     "Allow",
+		ScannerFile: scannerFile,
+		Threshold:   10,
+		Strategy:    strategyCount,
+		Merge:       mergeSum,
+		Output:      filepath.Join(t.TempDir(), "scp.json"),
+		Sort:        sortByName,
+		Oversize:    oversizeCompact,
+		Unknown:     unknownSourceWarn,
+		ReviewFmt:   reviewMarkdown,
+		Format:      formatJSON,
+		Content:     contentJSONEncode,
+	}
+}
+
+// TestRunServiceUsageReport tests the pipeline end to end
+// against a service_usage scanner report
+func TestRunServiceUsageReport(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, "Allow", scp.Statement[0].Effect)
+	assert.Equal(t, []string{"s3:GetObject", "s3:ListAllMyBuckets"}, []string(scp.Statement[0].Action))
+}
+
+// TestRunStdin tests the pipeline end to end reading
+// the scanner report from stdin
+func TestRunStdin(t *testing.T) {
+	stdin = strings.NewReader(getScannerMessage())
+	defer func() { stdin = os.Stdin }()
+	c := getTestSCPConfig(t, stdinSource)
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Contains(t, []string(scp.Statement[0].Action), "s3:GetObject")
+}
+
+// TestRunRoleUsageReport tests the pipeline end to end
+// against a role_usage scanner report
+func TestRunRoleUsageReport(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_usage.json")
+	c.Threshold = 80
+	c.Sort = sortByCount
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, []string{
+		"logs:DescribeLogStreams",
+		"kms:Decrypt",
+		"lambda:GetAccountSettings",
+		"s3:ListBucket",
+		"s3:ListAccessPoints",
+		"s3:GetBucketAcl",
+		"s3:GetBucketPolicyStatus",
+		"s3:GetBucketPublicAccessBlock",
+	}, []string(scp.Statement[0].Action))
+}
+
+// TestRunTopStrategy tests that the top strategy keeps
+// the most used api calls of each service
+func TestRunTopStrategy(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.Strategy = strategyTop
+	c.Threshold = 1
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, 1, len(scp.Statement[0].Action))
+}
+
+// TestRunThresholdsFile tests that per service and per
+// action rules from a thresholds file are applied
+func TestRunThresholdsFile(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.Thresholds = "./testdata/thresholds.yaml"
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Contains(t, []string(scp.Statement[0].Action), "s3:GetBucketNotification")
+}
+
+// TestRunBaselines tests that baseline actions are
+// always allowed and never allow actions left out
+func TestRunBaselines(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.Baseline = "./testdata/baseline.yaml"
+	c.Never = "./testdata/never.yaml"
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, []string{"s3:GetObject", "sts:AssumeRole", "support:DescribeCases"}, []string(scp.Statement[0].Action))
+}
+
+// TestRunDenyBaselines tests that never allow actions are
+// always denied and baseline actions never denied
+func TestRunDenyBaselines(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.SCPType = "Deny"
+	c.Threshold = 200
+	c.Baseline = "./testdata/never.yaml"
+	c.Never = "./testdata/baseline.yaml"
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, []string{"s3:GetBucketNotification", "sts:AssumeRole", "support:DescribeCases"}, []string(scp.Statement[0].Action))
+}
+
+// TestRunReview tests that a review report is written
+// next to the SCP
+func TestRunReview(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_usage.json")
+	c.Review = filepath.Dir(c.Output)
+	c.ReviewFmt = reviewHTML
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	review, _ := ioutil.ReadFile(filepath.Join(c.Review, defaultReviewHTML))
+	assert.Contains(t, string(review), "<td>platsec-development</td><td></td><td>2021</td><td>03</td><td class=\"count\">1</td>")
+}
+
+// TestRunTerraform tests that the SCP can be written
+// as terraform
+func TestRunTerraform(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.Output = filepath.Dir(c.Output)
+	c.Format = formatTerraform
+	c.Name = "scanner-usage"
+	c.Targets = "ou-ab12-34567890"
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	output, _ := ioutil.ReadFile(filepath.Join(c.Output, defaultTerraformFilename))
+	assert.Contains(t, string(output), `resource "aws_organizations_policy" "scanner_usage" {`)
+	assert.Contains(t, string(output), `target_id = "ou-ab12-34567890"`)
+}
+
+// TestRunDenyReport tests that a deny SCP lists the
+// rarely used actions
+func TestRunDenyReport(t *testing.T) {
+	c := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+	c.SCPType = "deny"
+
+	err := run(c)
+
+	assert.Nil(t, err)
+	scp, _ := loadSCP(c.Output)
+	assert.Equal(t, "Deny", scp.Statement[0].Effect)
+	assert.Equal(t, []string{"s3:GetBucketNotification"}, []string(scp.Statement[0].Action))
+}
+
+// TestRunExitCodes tests that each class of failure
+// is reported with its own exit code
+func TestRunExitCodes(t *testing.T) {
+	cases := []struct {
+		name     string
+		setup    func(c *SCPConfig)
+		stage    string
+		expected int
+	}{
+		{
+			name:     "invalid type",
+			setup:    func(c *SCPConfig) { c.SCPType = "Maybe" },
+			stage:    "validate",
+			expected: exitUsage,
+		},
+		{
+			name:     "missing scanner file",
+			setup:    func(c *SCPConfig) { c.ScannerFile = "./testdata/missing.json" },
+			stage:    "load",
+			expected: exitInput,
+		},
+		{
+			name:     "corrupt scanner file",
+			setup:    func(c *SCPConfig) { c.ScannerFile = "./testdata/golden/allow_by_name.json" },
+			stage:    "parse",
+			expected: exitInput,
+		},
+		{
+			name:     "invalid threshold",
+			setup:    func(c *SCPConfig) { c.Threshold = 0 },
+			stage:    "permissions",
+			expected: exitUsage,
+		},
+		{
+			name:     "invalid strategy",
+			setup:    func(c *SCPConfig) { c.Strategy = "median" },
+			stage:    "permissions",
+			expected: exitUsage,
+		},
+		{
+			name:     "missing thresholds file",
+			setup:    func(c *SCPConfig) { c.Thresholds = "./testdata/missing.yaml" },
+			stage:    "thresholds",
+			expected: exitInput,
+		},
+		{
+			name:     "invalid thresholds file",
+			setup:    func(c *SCPConfig) { c.Thresholds = "./testdata/s3_scanner_report.json" },
+			stage:    "thresholds",
+			expected: exitInput,
+		},
+		{
+			name:     "unknown thresholds field",
+			setup:    func(c *SCPConfig) { c.Thresholds = writeTestConfig(t, "services:\n  s3:\n    treshold: 5\n") },
+			stage:    "thresholds",
+			expected: exitUsage,
+		},
+		{
+			name:     "missing baseline file",
+			setup:    func(c *SCPConfig) { c.Baseline = "./testdata/missing.yaml" },
+			stage:    "baselines",
+			expected: exitInput,
+		},
+		{
+			name:     "invalid never allow file",
+			setup:    func(c *SCPConfig) { c.Never = "./testdata/thresholds.yaml" },
+			stage:    "baselines",
+			expected: exitInput,
+		},
+		{
+			name:     "unknown baseline field",
+			setup:    func(c *SCPConfig) { c.Baseline = writeTestConfig(t, "- action: sts:AssumeRole\n  reasons: sso\n") },
+			stage:    "baselines",
+			expected: exitUsage,
+		},
+		{
+			name: "conflicting baselines",
+			setup: func(c *SCPConfig) {
+				c.Baseline = "./testdata/never.yaml"
+				c.Never = "./testdata/never.yaml"
+			},
+			stage:    "baselines",
+			expected: exitInput,
+		},
+		{
+			name: "unknown event source",
+			setup: func(c *SCPConfig) {
+				c.ScannerFile = writeTestReport(t, "unknown.amazonaws.com", 1)
+				c.Unknown = unknownSourceError
+			},
+			stage:    "permissions",
+			expected: exitInput,
+		},
+		{
+			name: "invalid review format",
+			setup: func(c *SCPConfig) {
+				c.Review = stdoutDestination
+				c.ReviewFmt = "pdf"
+			},
+			stage:    "validate",
+			expected: exitUsage,
+		},
+		{
+			name: "existing review",
+			setup: func(c *SCPConfig) {
+				c.Review = filepath.Join(filepath.Dir(c.Output), "review.md")
+				ioutil.WriteFile(c.Review, []byte("existing"), 0644)
+			},
+			stage:    "review",
+			expected: exitOutput,
+		},
+		{
+			name:     "invalid format",
+			setup:    func(c *SCPConfig) { c.Format = "xml" },
+			stage:    "validate",
+			expected: exitUsage,
+		},
+		{
+			name: "invalid terraform content",
+			setup: func(c *SCPConfig) {
+				c.Format = formatTerraform
+				c.Content = "file"
+			},
+			stage:    "validate",
+			expected: exitUsage,
+		},
+		{
+			name:     "invalid sort order",
+			setup:    func(c *SCPConfig) { c.Sort = "random" },
+			stage:    "generate",
+			expected: exitUsage,
+		},
+		{
+			name: "oversized scp",
+			setup: func(c *SCPConfig) {
+				c.ScannerFile = writeTestReport(t, "s3.amazonaws.com", 1000)
+				c.Oversize = oversizeError
+			},
+			stage:    "size",
+			expected: exitPolicy,
+		},
+		{
+			name:     "empty scp",
+			setup:    func(c *SCPConfig) { c.Threshold = 100000 },
+			stage:    "size",
+			expected: exitPolicy,
+		},
+		{
+			name: "existing output",
+			setup: func(c *SCPConfig) {
+				ioutil.WriteFile(c.Output, []byte("existing"), 0644)
+			},
+			stage:    "save",
+			expected: exitOutput,
+		},
+	}
+
+	for _, c := range cases {
+		config := getTestSCPConfig(t, "./testdata/s3_scanner_report.json")
+		c.setup(config)
+
+		err := run(config)
+
+		var stageErr *StageError
+		assert.True(t, errors.As(err, &stageErr), c.name)
+		assert.Equal(t, c.stage, stageErr.Stage, c.name)
+		assert.Equal(t, c.expected, exitCode(err), c.name)
+		assert.True(t, strings.HasPrefix(err.Error(), c.stage+": "), c.name)
+	}
+}
+
+// TestExitCodeUnknownError tests that errors from outside
+// the pipeline use the generic exit code
+func TestExitCodeUnknownError(t *testing.T) {
+	assert.Equal(t, exitFail, exitCode(errors.New("unexpected")))
+}
+
+// writeTestReport writes a role_usage report with the given
+// number of made up api calls for an event source
+func writeTestReport(t *testing.T, eventSource string, calls int) string {
+	var usage []string
+	for i := 0; i < calls; i++ {
+		usage = append(usage, fmt.Sprintf(`{"event_source": "%s", "event_name": "GetThing%04d", "count": 50}`, eventSource, i))
+	}
+	report := `[{"account": {"identifier": "999888777666"}, "results": {"role_usage": [` + strings.Join(usage, ",") + `]}}]`
+
+	filename := filepath.Join(t.TempDir(), "report.json")
+	ioutil.WriteFile(filename, []byte(report), 0644)
+	return filename
+}
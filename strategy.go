@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// Selection strategies
+const (
+	strategyCount      = "count"
+	strategyPercent    = "percent"
+	strategyTop        = "top"
+	strategyPercentile = "percentile"
+	strategyAny        = "any"
+)
+
+// ErrInvalidStrategy is returned for an unknown selection strategy
+var ErrInvalidStrategy = errors.New("strategy must be count, percent, top, percentile or any")
+
+// serviceUsage holds the call counts of every api call of
+// a service, which strategies judge a single call against
+type serviceUsage struct {
+	counts []int64
+	total  int64
+}
+
+// newServiceUsage sorts the counts of a service in
+// descending order and totals them
+func newServiceUsage(counts []int64) serviceUsage {
+	usage := serviceUsage{counts: append([]int64{}, counts...)}
+	sort.Slice(usage.counts, func(i, j int) bool { return usage.counts[i] > usage.counts[j] })
+	for _, count := range usage.counts {
+		usage.total += count
+	}
+	return usage
+}
+
+// selectionStrategy decides whether an api call is used
+// enough to be selected, given the usage of its service
+type selectionStrategy interface {
+	selects(count int64, service serviceUsage) bool
+	describe() (string, int64)
+}
+
+// newStrategy returns the named strategy using the threshold
+// as its limit, which the any strategy ignores
+func newStrategy(name string, threshold int64) (selectionStrategy, error) {
+	if name == strategyAny {
+		return anyStrategy{}, nil
+	}
+
+	if threshold <= 0 {
+		return nil, ErrInvalidThreshold
+	}
+
+	switch name {
+	case strategyCount:
+		return countStrategy{threshold: threshold}, nil
+	case strategyPercent:
+		if threshold > 100 {
+			return nil, ErrInvalidThreshold
+		}
+		return percentStrategy{percent: threshold}, nil
+	case strategyTop:
+		return topStrategy{n: threshold}, nil
+	case strategyPercentile:
+		if threshold > 100 {
+			return nil, ErrInvalidThreshold
+		}
+		return percentileStrategy{percentile: threshold}, nil
+	}
+	return nil, ErrInvalidStrategy
+}
+
+// countStrategy selects calls made at least threshold times
+type countStrategy struct {
+	threshold int64
+}
+
+func (s countStrategy) selects(count int64, _ serviceUsage) bool {
+	return greaterThan(count, s.threshold)
+}
+
+func (s countStrategy) describe() (string, int64) {
+	return strategyCount, s.threshold
+}
+
+// percentStrategy selects calls that make up at least the
+// given percentage of all calls to their service
+type percentStrategy struct {
+	percent int64
+}
+
+func (s percentStrategy) selects(count int64, service serviceUsage) bool {
+	return service.total > 0 && count*100 >= s.percent*service.total
+}
+
+func (s percentStrategy) describe() (string, int64) {
+	return strategyPercent, s.percent
+}
+
+// topStrategy selects the n most used calls of each service,
+// along with any calls tied with the last of them
+type topStrategy struct {
+	n int64
+}
+
+func (s topStrategy) selects(count int64, service serviceUsage) bool {
+	if len(service.counts) == 0 {
+		return false
+	}
+	last := s.n
+	if last > int64(len(service.counts)) {
+		last = int64(len(service.counts))
+	}
+	return count >= service.counts[last-1]
+}
+
+func (s topStrategy) describe() (string, int64) {
+	return strategyTop, s.n
+}
+
+// percentileStrategy selects calls whose count is at or
+// above the given nearest rank percentile of their service
+type percentileStrategy struct {
+	percentile int64
+}
+
+func (s percentileStrategy) selects(count int64, service serviceUsage) bool {
+	n := int64(len(service.counts))
+	if n == 0 {
+		return false
+	}
+	rank := (s.percentile*n + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	// counts are in descending order, so rank from the end
+	return count >= service.counts[n-rank]
+}
+
+func (s percentileStrategy) describe() (string, int64) {
+	return strategyPercentile, s.percentile
+}
+
+// anyStrategy selects every call that was made at all
+type anyStrategy struct{}
+
+func (anyStrategy) selects(count int64, _ serviceUsage) bool {
+	return count > 0
+}
+
+func (anyStrategy) describe() (string, int64) {
+	return strategyAny, 0
+}
+
+// inverseStrategy selects the calls another strategy does
+// not, which is how deny lists are built
+type inverseStrategy struct {
+	selectionStrategy
+}
+
+func (s inverseStrategy) selects(count int64, service serviceUsage) bool {
+	return !s.selectionStrategy.selects(count, service)
+}
+
+func (s inverseStrategy) describe() (string, int64) {
+	name, threshold := s.selectionStrategy.describe()
+	return "not " + name, threshold
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNewServiceUsage tests that counts are sorted in
+// descending order and totalled
+func TestNewServiceUsage(t *testing.T) {
+	counts := []int64{5, 50, 1}
+	usage := newServiceUsage(counts)
+
+	assert.Equal(t, []int64{50, 5, 1}, usage.counts)
+	assert.Equal(t, int64(56), usage.total)
+	assert.Equal(t, []int64{5, 50, 1}, counts)
+}
+
+// TestNewStrategy tests that each strategy is created
+// and invalid thresholds and names are rejected
+func TestNewStrategy(t *testing.T) {
+	cases := []struct {
+		name      string
+		threshold int64
+		expected  selectionStrategy
+		err       error
+	}{
+		{name: strategyCount, threshold: 10, expected: countStrategy{threshold: 10}},
+		{name: strategyPercent, threshold: 10, expected: percentStrategy{percent: 10}},
+		{name: strategyTop, threshold: 10, expected: topStrategy{n: 10}},
+		{name: strategyPercentile, threshold: 10, expected: percentileStrategy{percentile: 10}},
+		{name: strategyAny, threshold: 0, expected: anyStrategy{}},
+		{name: strategyCount, threshold: 0, err: ErrInvalidThreshold},
+		{name: strategyTop, threshold: -1, err: ErrInvalidThreshold},
+		{name: strategyPercent, threshold: 101, err: ErrInvalidThreshold},
+		{name: strategyPercentile, threshold: 101, err: ErrInvalidThreshold},
+		{name: "median", threshold: 10, err: ErrInvalidStrategy},
+	}
+
+	for _, c := range cases {
+		strategy, err := newStrategy(c.name, c.threshold)
+		assert.Equal(t, c.err, err, c.name)
+		assert.Equal(t, c.expected, strategy, c.name)
+	}
+}
+
+// TestStrategySelects tests which calls of a service
+// each strategy selects
+func TestStrategySelects(t *testing.T) {
+	service := newServiceUsage([]int64{100, 50, 30, 15, 5})
+
+	cases := []struct {
+		name     string
+		strategy selectionStrategy
+		expected []int64
+	}{
+		{name: "count", strategy: countStrategy{threshold: 30}, expected: []int64{100, 50, 30}},
+		{name: "percent", strategy: percentStrategy{percent: 25}, expected: []int64{100, 50}},
+		{name: "top", strategy: topStrategy{n: 2}, expected: []int64{100, 50}},
+		{name: "top beyond calls", strategy: topStrategy{n: 10}, expected: []int64{100, 50, 30, 15, 5}},
+		{name: "percentile", strategy: percentileStrategy{percentile: 50}, expected: []int64{100, 50, 30}},
+		{name: "any", strategy: anyStrategy{}, expected: []int64{100, 50, 30, 15, 5}},
+		{name: "inverse", strategy: inverseStrategy{countStrategy{threshold: 30}}, expected: []int64{15, 5}},
+	}
+
+	for _, c := range cases {
+		selected := []int64{}
+		for _, count := range service.counts {
+			if c.strategy.selects(count, service) {
+				selected = append(selected, count)
+			}
+		}
+		assert.Equal(t, c.expected, selected, c.name)
+	}
+}
+
+// TestStrategySelectsUnusedService tests that nothing
+// is selected from a service without any calls
+func TestStrategySelectsUnusedService(t *testing.T) {
+	service := newServiceUsage(nil)
+
+	assert.False(t, percentStrategy{percent: 10}.selects(0, service))
+	assert.False(t, topStrategy{n: 1}.selects(0, service))
+	assert.False(t, percentileStrategy{percentile: 10}.selects(0, service))
+	assert.False(t, anyStrategy{}.selects(0, service))
+}
+
+// TestTopStrategyKeepsTies tests that calls tied with
+// the last of the top n are selected too
+func TestTopStrategyKeepsTies(t *testing.T) {
+	service := newServiceUsage([]int64{10, 7, 7, 2})
+
+	assert.True(t, topStrategy{n: 2}.selects(7, service))
+	assert.False(t, topStrategy{n: 2}.selects(2, service))
+}
+
+// TestGenerateListPerService tests that each call is
+// judged against the usage of its own service
+func TestGenerateListPerService(t *testing.T) {
+	report := Report{Usage: []Usage{
+		{EventSource: "s3.amazonaws.com", EventName: "GetObject", Count: 1000},
+		{EventSource: "s3.amazonaws.com", EventName: "PutObject", Count: 10},
+		{EventSource: "iam.amazonaws.com", EventName: "GetRole", Count: 3},
+	}}
+
+	allowList := generateList(strategySet{fallback: topStrategy{n: 1}}, &report, defaultEventSources)
+
+	assert.Equal(t, permissions{"s3": {"GetObject": 1000}, "iam": {"GetRole": 3}}, allowList)
+}
+
+// TestStrategyDescribe tests the name and threshold
+// each strategy reports
+func TestStrategyDescribe(t *testing.T) {
+	cases := []struct {
+		strategy  selectionStrategy
+		name      string
+		threshold int64
+	}{
+		{strategy: countStrategy{threshold: 10}, name: strategyCount, threshold: 10},
+		{strategy: percentStrategy{percent: 5}, name: strategyPercent, threshold: 5},
+		{strategy: topStrategy{n: 3}, name: strategyTop, threshold: 3},
+		{strategy: percentileStrategy{percentile: 90}, name: strategyPercentile, threshold: 90},
+		{strategy: anyStrategy{}, name: strategyAny, threshold: 0},
+		{strategy: inverseStrategy{topStrategy{n: 3}}, name: "not top", threshold: 3},
+	}
+
+	for _, c := range cases {
+		name, threshold := c.strategy.describe()
+		assert.Equal(t, c.name, name)
+		assert.Equal(t, c.threshold, threshold)
+	}
+}
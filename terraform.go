@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Terraform policy content styles
+const (
+	contentJSONEncode = "jsonencode"
+	contentHeredoc    = "heredoc"
+)
+
+const defaultTerraformFilename = "testSCP.tf"
+
+var ErrInvalidTerraformContent = errors.New("terraform content must be jsonencode or heredoc")
+
+// invalidIdentifier matches the characters that are
+// left out of terraform resource names
+var invalidIdentifier = regexp.MustCompile(`[^a-z0-9_]`)
+
+// terraformIdentifier turns a name into a terraform
+// resource name, which must start with a letter or _
+func terraformIdentifier(name string) string {
+	identifier := identifierSuffix(name)
+	if identifier == "" || identifier[0] >= '0' && identifier[0] <= '9' {
+		identifier = "_" + identifier
+	}
+	return identifier
+}
+
+// identifierSuffix turns a name into a string that can
+// be appended to a terraform resource name
+func identifierSuffix(name string) string {
+	return invalidIdentifier.ReplaceAllString(strings.ToLower(name), "_")
+}
+
+// attachmentSuffixes returns the resource name suffix of
+// the attachment of each target. Ids such as ou-1 and ou_1
+// give the same suffix, so a suffix already taken has the
+// position of its target appended.
+func attachmentSuffixes(targets []string) []string {
+	var suffixes []string
+	used := map[string]bool{}
+	for i, target := range targets {
+		suffix := identifierSuffix(target)
+		for n := i + 1; used[suffix]; n++ {
+			suffix = fmt.Sprintf("%s_%d", identifierSuffix(target), n)
+		}
+		used[suffix] = true
+		suffixes = append(suffixes, suffix)
+	}
+	return suffixes
+}
+
+// escapeTemplate stops terraform treating ${ and %{ in
+// policy text as template sequences
+func escapeTemplate(s string) string {
+	return strings.NewReplacer("${", "$${", "%{", "%%{").Replace(s)
+}
+
+// hclString quotes a string for terraform
+func hclString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return escapeTemplate(string(quoted))
+}
+
+// renderTerraform renders each document as an
+// aws_organizations_policy resource, attached to every
+// target. Documents of a split SCP are numbered.
+func renderTerraform(documents []SCP, details policyDetails, content string) ([]byte, error) {
+	if content != contentJSONEncode && content != contentHeredoc {
+		return nil, ErrInvalidTerraformContent
+	}
+
+	suffixes := attachmentSuffixes(details.Targets)
+	var output bytes.Buffer
+	for i, scp := range documents {
+		name, resource := details.Name, terraformIdentifier(details.Name)
+		if len(documents) > 1 {
+			name += "-" + strconv.Itoa(i+1)
+			resource += "_" + strconv.Itoa(i+1)
+		}
+		if i > 0 {
+			output.WriteString("\n")
+		}
+
+		policy, err := json.MarshalIndent(scp, "  ", "  ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&output, "resource \"aws_organizations_policy\" %q {\n", resource)
+		fmt.Fprintf(&output, "  name        = %s\n", hclString(name))
+		fmt.Fprintf(&output, "  description = %s\n", hclString(details.Description))
+		fmt.Fprintf(&output, "  type        = \"SERVICE_CONTROL_POLICY\"\n")
+		if content == contentHeredoc {
+			fmt.Fprintf(&output, "  content     = <<-EOT\n  %s\n  EOT\n", escapeTemplate(string(policy)))
+		} else {
+			fmt.Fprintf(&output, "  content     = jsonencode(%s)\n", escapeTemplate(string(policy)))
+		}
+		output.WriteString("}\n")
+
+		for j, target := range details.Targets {
+			fmt.Fprintf(&output, "\nresource \"aws_organizations_policy_attachment\" %q {\n", resource+"_"+suffixes[j])
+			fmt.Fprintf(&output, "  policy_id = aws_organizations_policy.%s.id\n", resource)
+			fmt.Fprintf(&output, "  target_id = %s\n", hclString(target))
+			output.WriteString("}\n")
+		}
+	}
+	return output.Bytes(), nil
+}
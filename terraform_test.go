@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseTargets tests that target ids are split
+// and blanks and repeats dropped
+func TestParseTargets(t *testing.T) {
+	assert.Equal(t, []string{"ou-ab12-34567890", "123456789012"}, parseTargets(" ou-ab12-34567890, ,123456789012,ou-ab12-34567890"))
+	assert.Nil(t, parseTargets(""))
+}
+
+// TestAttachmentSuffixes tests that targets giving the
+// same resource name are told apart by their position
+func TestAttachmentSuffixes(t *testing.T) {
+	assert.Equal(t, []string{"ou_1", "ou_1_2", "r_ab12", "ou_1_2_4"}, attachmentSuffixes([]string{"ou-1", "ou_1", "r-ab12", "OU_1_2"}))
+
+	output, err := renderTerraform([]SCP{generateSCP("Allow", permissions{"s3": {"GetObject": 1}}, sortByName, nil)},
+		policyDetails{Name: "allow", Targets: []string{"ou-1", "ou_1"}}, contentJSONEncode)
+	assert.Nil(t, err)
+	assert.Contains(t, string(output), `resource "aws_organizations_policy_attachment" "allow_ou_1" {`)
+	assert.Contains(t, string(output), `resource "aws_organizations_policy_attachment" "allow_ou_1_2" {`)
+}
+
+// TestTerraformIdentifier tests that names become
+// valid terraform resource names
+func TestTerraformIdentifier(t *testing.T) {
+	assert.Equal(t, "scanner_usage", terraformIdentifier("Scanner-Usage"))
+	assert.Equal(t, "_2021_policy", terraformIdentifier("2021 policy"))
+	assert.Equal(t, "_", terraformIdentifier(""))
+	assert.Equal(t, "123456789012", identifierSuffix("123456789012"))
+}
+
+// TestHCLString tests that strings are quoted and
+// template sequences escaped
+func TestHCLString(t *testing.T) {
+	assert.Equal(t, `"say \"hi\" to $${aws:username} and %%{if}"`, hclString(`say "hi" to ${aws:username} and %{if}`))
+}
+
+// TestRenderTerraformGolden tests that terraform output
+// is byte identical to the golden files in testdata/golden.
+// Run go test -update to regenerate them.
+func TestRenderTerraformGolden(t *testing.T) {
+	scp := generateSCP("Deny", permissions{"s3": {"PutObject": 1, "DeleteObject": 1}}, sortByName, nil)
+	scp.Statement[0].Condition = map[string]map[string]interface{}{"StringNotLike": {"aws:PrincipalArn": "arn:aws:iam::*:role/${aws:username}"}}
+	details := policyDetails{Name: "platform-deny", Description: "Denies unused s3 writes", Targets: []string{"ou-ab12-34567890", "123456789012"}}
+
+	for _, content := range []string{contentJSONEncode, contentHeredoc} {
+		output, err := renderTerraform([]SCP{scp}, details, content)
+		assert.Nil(t, err)
+
+		goldenFile := filepath.Join("testdata", "golden", "deny_"+content+".tf")
+		if *update {
+			ioutil.WriteFile(goldenFile, output, 0644)
+		}
+		expected, _ := ioutil.ReadFile(goldenFile)
+		assert.Equal(t, string(expected), string(output), content)
+	}
+}
+
+// TestRenderTerraformSplit tests that each document of
+// a split SCP gets its own numbered resource
+func TestRenderTerraformSplit(t *testing.T) {
+	documents, _ := splitSCP(generateSCP("Deny", getLargePermissions(500), sortByName, nil), maxSCPSize)
+
+	output, err := renderTerraform(documents, policyDetails{Name: "large", Targets: []string{"r-ab12"}}, contentJSONEncode)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(documents), strings.Count(string(output), `resource "aws_organizations_policy" `))
+	assert.Contains(t, string(output), `resource "aws_organizations_policy" "large_2" {`)
+	assert.Contains(t, string(output), `name        = "large-2"`)
+	assert.Contains(t, string(output), `resource "aws_organizations_policy_attachment" "large_3_r_ab12" {`)
+}
+
+// TestRenderTerraformInvalidContent tests that an unknown
+// content style is rejected
+func TestRenderTerraformInvalidContent(t *testing.T) {
+	_, err := renderTerraform(nil, policyDetails{}, "file")
+	assert.Equal(t, ErrInvalidTerraformContent, err)
+}
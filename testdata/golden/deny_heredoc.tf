@@ -0,0 +1,38 @@
+resource "aws_organizations_policy" "platform_deny" {
+  name        = "platform-deny"
+  description = "Denies unused s3 writes"
+  type        = "SERVICE_CONTROL_POLICY"
+  content     = <<-EOT
+  {
+    "Version": "2012-10-17",
+    "Statement": [
+      {
+        "Sid": "DenyScannerUsage",
+        "Effect": "Deny",
+        "Action": [
+          "s3:DeleteObject",
+          "s3:PutObject"
+        ],
+        "Resource": [
+          "*"
+        ],
+        "Condition": {
+          "StringNotLike": {
+            "aws:PrincipalArn": "arn:aws:iam::*:role/$${aws:username}"
+          }
+        }
+      }
+    ]
+  }
+  EOT
+}
+
+resource "aws_organizations_policy_attachment" "platform_deny_ou_ab12_34567890" {
+  policy_id = aws_organizations_policy.platform_deny.id
+  target_id = "ou-ab12-34567890"
+}
+
+resource "aws_organizations_policy_attachment" "platform_deny_123456789012" {
+  policy_id = aws_organizations_policy.platform_deny.id
+  target_id = "123456789012"
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrUnknownField = errors.New("unknown field")
+
+// thresholdRule sets the strategy and threshold used to
+// select api calls. Either may be left out to inherit it
+// from the next less specific rule.
+type thresholdRule struct {
+	Strategy  string `yaml:"strategy" json:"strategy"`
+	Threshold *int64 `yaml:"threshold" json:"threshold"`
+}
+
+// thresholdConfig holds the rules read from a thresholds
+// file. Services are keyed by iam prefix, s3, and actions
+// by prefix and iam action name, s3:GetObject.
+type thresholdConfig struct {
+	Default  thresholdRule            `yaml:"default" json:"default"`
+	Services map[string]thresholdRule `yaml:"services" json:"services"`
+	Actions  map[string]thresholdRule `yaml:"actions" json:"actions"`
+}
+
+// loadThresholds decodes a thresholds file, which may be
+// YAML or JSON as YAML is a superset of it
+func loadThresholds(data []byte) (thresholdConfig, error) {
+	config := thresholdConfig{}
+	if err := decodeKnownFields(data, &config); err != nil {
+		return thresholdConfig{}, err
+	}
+	return config, nil
+}
+
+// decodeKnownFields decodes a YAML or JSON file, failing
+// with ErrUnknownField on a field out has no place for, so
+// a misspelt key is not silently ignored. An empty file
+// decodes to nothing.
+func decodeKnownFields(data []byte, out interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(out)
+	if err == io.EOF {
+		return nil
+	}
+
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, e := range typeErr.Errors {
+			if strings.Contains(e, " not found in type ") {
+				return fmt.Errorf("%w: %s", ErrUnknownField, strings.Join(typeErr.Errors, ", "))
+			}
+		}
+	}
+	return err
+}
+
+// unmatchedActions returns the action rules that name no
+// iam action of the usage nor any the catalog knows, such
+// as a rule written for an event name. used holds the
+// service:action of the usage in lower case.
+func (c thresholdConfig) unmatchedActions(used map[string][]string, catalog actionCatalog) []string {
+	var unmatched []string
+	for action := range c.Actions {
+		if _, ok := used[strings.ToLower(action)]; ok {
+			continue
+		}
+		prefix, name := splitAction(action)
+		_, service, _ := catalog.service(prefix)
+		if _, ok := service.action(name); !ok {
+			unmatched = append(unmatched, action)
+		}
+	}
+	sort.Strings(unmatched)
+	return unmatched
+}
+
+// inherit fills in the fields the rule leaves out
+// from a less specific rule
+func (r thresholdRule) inherit(parent thresholdRule) thresholdRule {
+	if r.Strategy == "" {
+		r.Strategy = parent.Strategy
+	}
+	if r.Threshold == nil {
+		r.Threshold = parent.Threshold
+	}
+	return r
+}
+
+// strategy returns the selection strategy the rule describes
+func (r thresholdRule) strategy() (selectionStrategy, error) {
+	var threshold int64
+	if r.Threshold != nil {
+		threshold = *r.Threshold
+	}
+	return newStrategy(r.Strategy, threshold)
+}
+
+// strategySet holds the selection strategy of every
+// service and action with a rule of its own, along with
+// the fallback used for everything else
+type strategySet struct {
+	fallback selectionStrategy
+	services map[string]selectionStrategy
+	actions  map[string]selectionStrategy
+}
+
+// newStrategySet resolves the rules of a thresholds file
+// into strategies. The -strategy and -threshold values are
+// the fallback for anything the file leaves out.
+func newStrategySet(name string, threshold int64, config thresholdConfig) (strategySet, error) {
+	base := thresholdRule{Strategy: name, Threshold: &threshold}
+	defaultRule := config.Default.inherit(base)
+
+	fallback, err := defaultRule.strategy()
+	if err != nil {
+		return strategySet{}, err
+	}
+	set := strategySet{fallback: fallback, services: map[string]selectionStrategy{}, actions: map[string]selectionStrategy{}}
+
+	serviceRules := map[string]thresholdRule{}
+	for service, rule := range config.Services {
+		key := strings.ToLower(service)
+		serviceRules[key] = rule.inherit(defaultRule)
+		strategy, err := serviceRules[key].strategy()
+		if err != nil {
+			return strategySet{}, fmt.Errorf("service %s: %w", service, err)
+		}
+		set.services[key] = strategy
+	}
+
+	for action, rule := range config.Actions {
+		parent, ok := serviceRules[strings.ToLower(strings.SplitN(action, ":", 2)[0])]
+		if !ok {
+			parent = defaultRule
+		}
+		strategy, err := rule.inherit(parent).strategy()
+		if err != nil {
+			return strategySet{}, fmt.Errorf("action %s: %w", action, err)
+		}
+		set.actions[strings.ToLower(action)] = strategy
+	}
+	return set, nil
+}
+
+// strategyFor returns the most specific strategy for
+// an api call, matching its action before its service
+func (s strategySet) strategyFor(service string, eventName string) selectionStrategy {
+	if strategy, ok := s.actions[strings.ToLower(service+":"+eventName)]; ok {
+		return strategy
+	}
+	if strategy, ok := s.services[strings.ToLower(service)]; ok {
+		return strategy
+	}
+	return s.fallback
+}
+
+// invert returns the set with every strategy inverted,
+// which is how deny lists are built
+func (s strategySet) invert() strategySet {
+	inverted := strategySet{fallback: inverseStrategy{s.fallback}, services: map[string]selectionStrategy{}, actions: map[string]selectionStrategy{}}
+	for service, strategy := range s.services {
+		inverted.services[service] = inverseStrategy{strategy}
+	}
+	for action, strategy := range s.actions {
+		inverted.actions[action] = inverseStrategy{strategy}
+	}
+	return inverted
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadThresholds tests that YAML and JSON thresholds
+// files are decoded
+func TestLoadThresholds(t *testing.T) {
+	yamlConfig, err := loadThresholds([]byte("services:\n  s3:\n    strategy: percent\n    threshold: 5\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, strategyPercent, yamlConfig.Services["s3"].Strategy)
+	assert.Equal(t, int64(5), *yamlConfig.Services["s3"].Threshold)
+
+	jsonConfig, err := loadThresholds([]byte(`{"actions": {"iam:CreateRole": {"strategy": "any"}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, strategyAny, jsonConfig.Actions["iam:CreateRole"].Strategy)
+	assert.Nil(t, jsonConfig.Actions["iam:CreateRole"].Threshold)
+
+	_, err = loadThresholds([]byte("services: [s3"))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnknownField))
+
+	empty, err := loadThresholds(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, thresholdConfig{}, empty)
+}
+
+// TestLoadThresholdsUnknownField tests that a misspelt
+// key is an error rather than silently ignored
+func TestLoadThresholdsUnknownField(t *testing.T) {
+	cases := []string{
+		"service:\n  s3:\n    threshold: 5\n",
+		"services:\n  s3:\n    treshold: 5\n",
+		`{"default": {"strategy": "top", "limit": 5}}`,
+	}
+
+	for _, c := range cases {
+		_, err := loadThresholds([]byte(c))
+		assert.True(t, errors.Is(err, ErrUnknownField), c)
+	}
+}
+
+// TestUnmatchedActions tests that action rules naming
+// neither a used nor a catalogued iam action are reported
+func TestUnmatchedActions(t *testing.T) {
+	config, _ := loadThresholds([]byte(`
+actions:
+  s3:ListBucket: {strategy: any}
+  s3:ListObjects: {strategy: any}
+  xray:GetGroups: {strategy: any}
+  xray:GetTraceSummaries: {strategy: any}
+  STS:assumerole: {strategy: any}
+`))
+	used := map[string][]string{"xray:getgroups": {"GetGroups"}}
+
+	assert.Equal(t, []string{"s3:ListObjects", "xray:GetTraceSummaries"}, config.unmatchedActions(used, defaultCatalog))
+}
+
+// TestStrategySetMostSpecific tests that an action rule
+// wins over its service rule, which wins over the default,
+// and that missing fields are inherited
+func TestStrategySetMostSpecific(t *testing.T) {
+	config, _ := loadThresholds([]byte(`
+default:
+  threshold: 100
+services:
+  S3:
+    strategy: top
+    threshold: 2
+  iam:
+    threshold: 1
+actions:
+  s3:GetObject:
+    threshold: 5
+  kms:Decrypt:
+    strategy: any
+`))
+
+	set, err := newStrategySet(strategyCount, 10, config)
+
+	assert.Nil(t, err)
+	assert.Equal(t, countStrategy{threshold: 100}, set.strategyFor("ec2", "DescribeInstances"))
+	assert.Equal(t, topStrategy{n: 2}, set.strategyFor("s3", "PutObject"))
+	assert.Equal(t, topStrategy{n: 5}, set.strategyFor("s3", "GetObject"))
+	assert.Equal(t, countStrategy{threshold: 1}, set.strategyFor("iam", "GetRole"))
+	assert.Equal(t, anyStrategy{}, set.strategyFor("kms", "Decrypt"))
+	assert.Equal(t, countStrategy{threshold: 100}, set.strategyFor("kms", "Encrypt"))
+}
+
+// TestStrategySetFallsBackToFlags tests that the flag
+// strategy and threshold are used without a file
+func TestStrategySetFallsBackToFlags(t *testing.T) {
+	set, err := newStrategySet(strategyPercent, 10, thresholdConfig{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, percentStrategy{percent: 10}, set.strategyFor("s3", "GetObject"))
+}
+
+// TestStrategySetInvalidRules tests that an invalid rule
+// is reported along with where it was found
+func TestStrategySetInvalidRules(t *testing.T) {
+	cases := []struct {
+		config   string
+		expected error
+		message  string
+	}{
+		{config: "default:\n  threshold: 0\n", expected: ErrInvalidThreshold, message: "threshold limit must be greater than zero"},
+		{config: "services:\n  s3:\n    strategy: median\n", expected: ErrInvalidStrategy, message: "service s3: "},
+		{config: "actions:\n  s3:GetObject:\n    strategy: percent\n    threshold: 200\n", expected: ErrInvalidThreshold, message: "action s3:GetObject: "},
+	}
+
+	for _, c := range cases {
+		config, _ := loadThresholds([]byte(c.config))
+		_, err := newStrategySet(strategyCount, 10, config)
+
+		assert.True(t, errors.Is(err, c.expected), c.config)
+		assert.Contains(t, err.Error(), c.message, c.config)
+	}
+}
+
+// TestStrategySetInvert tests that every strategy in
+// the set is inverted
+func TestStrategySetInvert(t *testing.T) {
+	config, _ := loadThresholds([]byte("services:\n  s3:\n    threshold: 1\nactions:\n  iam:GetRole:\n    strategy: any\n"))
+	set, _ := newStrategySet(strategyCount, 10, config)
+
+	inverted := set.invert()
+
+	assert.Equal(t, inverseStrategy{countStrategy{threshold: 10}}, inverted.strategyFor("ec2", "DescribeInstances"))
+	assert.Equal(t, inverseStrategy{countStrategy{threshold: 1}}, inverted.strategyFor("s3", "GetObject"))
+	assert.Equal(t, inverseStrategy{anyStrategy{}}, inverted.strategyFor("iam", "GetRole"))
+}